@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	// Time between a deletion request and the account actually being purged,
+	// during which the user can log in and cancel
+	accountDeletionGracePeriod = 30 * 24 * time.Hour
+	accountDeletionInterval    = time.Hour
+)
+
+var errNoDeletionPending = errors.New("no account deletion is pending")
+
+// A lobby the user took part in, as included in their data export
+type LobbyParticipation struct {
+	LobbyID      string    `json:"lobbyId"`
+	Creator      string    `json:"creator"`
+	Participants []string  `json:"participants"`
+	Status       string    `json:"status"`
+	CreatedAt    time.Time `json:"createdAt"`
+	Score        int       `json:"score"`
+}
+
+// Everything stored about a user, as returned by /user/export
+type PersonalDataExport struct {
+	ExportedAt       time.Time            `json:"exportedAt"`
+	Profile          User                 `json:"profile"`
+	CompletedLevels  []CompletedLevel     `json:"completedLevels"`
+	StreakData       StreakDataType       `json:"streakData"`
+	Lobbies          []LobbyParticipation `json:"lobbies"`
+	ParentalConsents []ConsentRecord      `json:"parentalConsents"`
+	AuditEvents      []AuditEvent         `json:"auditEvents"`
+}
+
+// Download everything stored about the authenticated user as a JSON file
+func (s *Server) handleExportUserData(w http.ResponseWriter, r *http.Request) {
+	username := authenticatedUsername(r)
+
+	user, err := s.users.GetUser(r.Context(), username)
+	if err != nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	lobbies, err := s.lobbies.ListLobbiesByParticipant(r.Context(), username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve lobbies")
+		return
+	}
+
+	consents, err := s.consents.ListConsentRecords(r.Context(), username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve consent records")
+		return
+	}
+
+	auditEvents, err := s.auditLog.QueryAuditEvents(r.Context(), AuditQuery{User: username})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve audit events")
+		return
+	}
+
+	export := PersonalDataExport{
+		ExportedAt:       time.Now(),
+		Profile:          user,
+		CompletedLevels:  user.CompletedLevels,
+		StreakData:       user.StreakData,
+		Lobbies:          make([]LobbyParticipation, 0, len(lobbies)),
+		ParentalConsents: consents,
+		AuditEvents:      auditEvents,
+	}
+	for _, lobby := range lobbies {
+		export.Lobbies = append(export.Lobbies, LobbyParticipation{
+			LobbyID:      lobby.ID,
+			Creator:      lobby.Creator,
+			Participants: lobby.Participants,
+			Status:       lobby.Status,
+			CreatedAt:    lobby.CreatedAt,
+			Score:        lobby.Scores[username],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", username+"-data.json"))
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(export)
+}
+
+// Schedule the authenticated user's account for deletion after the grace period
+func (s *Server) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Password string `json:"password"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	username := authenticatedUsername(r)
+
+	user, err := s.users.GetUser(r.Context(), username)
+	if err != nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	if !CheckPasswordHash(requestData.Password, user.PasswordHash) {
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "Password is incorrect")
+		return
+	}
+
+	scheduledFor := time.Now().Add(accountDeletionGracePeriod)
+	_, err = s.updateUser(r.Context(), username, func(user *User) error {
+		user.DeletionScheduledFor = &scheduledFor
+		return nil
+	})
+	if err != nil {
+		writeSaveError(w, err, "Failed to schedule account deletion")
+		return
+	}
+
+	s.recordAudit(r, username, auditDeletionRequested, username, map[string]string{"scheduledFor": scheduledFor.Format(time.RFC3339)})
+
+	writeJSON(w, http.StatusAccepted, map[string]time.Time{"deletionScheduledFor": scheduledFor})
+}
+
+// Cancel a pending deletion during the grace period
+func (s *Server) handleCancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	username := authenticatedUsername(r)
+
+	_, err := s.updateUser(r.Context(), username, func(user *User) error {
+		if user.DeletionScheduledFor == nil {
+			return errNoDeletionPending
+		}
+		user.DeletionScheduledFor = nil
+		return nil
+	})
+	if err == errNoDeletionPending {
+		writeError(w, http.StatusConflict, codeConflict, "No account deletion is pending")
+		return
+	}
+	if err != nil {
+		writeSaveError(w, err, "Failed to cancel account deletion")
+		return
+	}
+
+	s.recordAudit(r, username, auditDeletionCancelled, username, nil)
+
+	writeMessage(w, http.StatusOK, "Account deletion cancelled")
+}
+
+// Periodically purge accounts whose deletion grace period has ended
+func (s *Server) runAccountDeletionWorker(ctx context.Context) {
+	ticker := time.NewTicker(accountDeletionInterval)
+	defer ticker.Stop()
+
+	for {
+		s.purgeDueAccounts(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) purgeDueAccounts(ctx context.Context) {
+	users, err := s.users.UsersPendingDeletion(ctx, time.Now())
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to look up accounts due for deletion", "error", err)
+		return
+	}
+
+	for _, user := range users {
+		if err := s.purgeUser(ctx, user.Username); err != nil {
+			slog.ErrorContext(ctx, "Failed to delete account", "username", user.Username, "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "Deleted account", "username", user.Username)
+	}
+}
+
+// Remove a user for good. Lobbies they played in are kept for the other
+// players, and audit and parental consent records for compliance, all with
+// the username replaced by an anonymous placeholder, so someone who later
+// signs up with the same name never sees them in their export.
+func (s *Server) purgeUser(ctx context.Context, username string) error {
+	placeholder, err := anonymousUsername()
+	if err != nil {
+		return err
+	}
+
+	lobbies, err := s.lobbies.ListLobbiesByParticipant(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	for _, lobby := range lobbies {
+		_, err := s.updateLobby(ctx, lobby.ID, func(lobby *Lobby) error {
+			anonymizeLobby(lobby, username, placeholder)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := s.auditLog.PseudonymizeAuditEvents(ctx, username, placeholder); err != nil {
+		return err
+	}
+	if err := s.consents.PseudonymizeConsentRecords(ctx, username, placeholder); err != nil {
+		return err
+	}
+	if err := s.tokens.DeleteUserTokens(ctx, username); err != nil {
+		return err
+	}
+	if err := s.users.DeleteUser(ctx, username); err != nil {
+		return err
+	}
+
+	s.recordSystemAudit(ctx, auditAccountDeleted, placeholder, nil)
+	return nil
+}
+
+// Replace every occurrence of a username in a lobby
+func anonymizeLobby(lobby *Lobby, username, placeholder string) {
+	if lobby.Creator == username {
+		lobby.Creator = placeholder
+	}
+	for i, participant := range lobby.Participants {
+		if participant == username {
+			lobby.Participants[i] = placeholder
+		}
+	}
+	if score, ok := lobby.Scores[username]; ok {
+		delete(lobby.Scores, username)
+		lobby.Scores[placeholder] = score
+	}
+}
+
+// Random placeholder so deleted users cannot be recovered by hashing guesses
+func anonymousUsername() (string, error) {
+	raw := make([]byte, 6)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return "deleted-user-" + hex.EncodeToString(raw), nil
+}
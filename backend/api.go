@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Prefix of the current API version, which deprecated routes point clients to
+const currentAPIPrefix = "/api/v1"
+
+// A version of the HTTP API, mounted under its own prefix. To change a
+// response shape, add a version whose routes start from a copy of the
+// previous version's and replace only the handlers that differ, e.g.
+//
+//	{prefix: "/api/v2", routes: s.v2Routes}
+//
+// with v2Routes cloning v1Routes. Both versions are then served side by side
+// until the old one is deprecated and, after its sunset, removed.
+type apiVersion struct {
+	prefix string
+	// Method and path patterns, relative to the prefix, and their handlers
+	routes func() map[string]http.HandlerFunc
+	// Set once the version is deprecated
+	deprecation *apiDeprecation
+}
+
+// Deprecation and Sunset headers (RFC 9745 and RFC 8594) announced by every
+// response from a deprecated API version
+type apiDeprecation struct {
+	since     time.Time
+	sunset    time.Time
+	successor string // prefix of the version replacing this one
+
+	mu     sync.Mutex // guards logged
+	logged map[deprecatedCaller]time.Time
+}
+
+// A client calling a deprecated route, logged once per deprecationLogInterval
+type deprecatedCaller struct {
+	route, ip, userAgent string
+}
+
+// How often the same client calling the same deprecated route is logged
+const deprecationLogInterval = time.Hour
+
+func (s *Server) apiVersions() []apiVersion {
+	return []apiVersion{
+		{prefix: "/api/v1", routes: s.v1Routes},
+		// Before /api/v1 every route was served from the root. They stay
+		// there for the shipped React app until the sunset.
+		{prefix: "", routes: s.unversionedRoutes, deprecation: &apiDeprecation{
+			since:     time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC),
+			sunset:    time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC),
+			successor: currentAPIPrefix,
+		}},
+	}
+}
+
+func (s *Server) v1Routes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		// Accounts
+		"POST /user/add":                     s.handleAddUser,
+		"POST /user/login":                   s.userLoginHandler,
+		"POST /user/login/2fa":               s.handleTwoFactorLogin,
+		"POST /user/refresh":                 s.refreshTokenHandler,
+		"POST /user/forgot-password":         s.handleForgotPassword,
+		"POST /user/reset-password":          s.handleResetPassword,
+		"POST /user/verify-email":            s.handleVerifyEmail,
+		"POST /user/resend-verification":     s.authMiddleware(s.handleResendVerification),
+		"POST /user/parental-consent":        s.handleGrantParentalConsent,
+		"POST /user/resend-parental-consent": s.authMiddleware(s.handleResendParentalConsent),
+		"GET /user/export":                   s.authMiddleware(s.handleExportUserData),
+		"POST /user/delete":                  s.authMiddleware(s.handleDeleteAccount),
+		"POST /user/delete/cancel":           s.authMiddleware(s.handleCancelAccountDeletion),
+		"POST /user/2fa/enroll":              s.authMiddleware(s.handleTwoFactorEnroll),
+		"POST /user/2fa/confirm":             s.authMiddleware(s.handleTwoFactorConfirm),
+		"POST /user/2fa/disable":             s.authMiddleware(s.handleTwoFactorDisable),
+
+		// Profiles
+		"GET /users/{username}":           s.authMiddleware(s.handleGetUser),
+		"PATCH /users/{username}":         s.requirePathUser(s.handleModifyUser),
+		"POST /users/{username}/password": s.requirePathUser(s.handleChangePassword),
+
+		// Administration
+		"GET /users":       s.requireRole(s.usersHandler, RoleAdmin),
+		"POST /user/role":  s.requireRole(s.setUserRoleHandler, RoleAdmin),
+		"GET /admin/audit": s.requireRole(s.auditLogHandler, RoleAdmin),
+
+		// Multiplayer
+		"GET /leaderboard":     s.requireUnrestrictedAccount(s.leaderboardHandler),
+		"GET /lobbies":         s.requireUnrestrictedAccount(s.searchLobbiesHandler),
+		"POST /lobby/create":   s.refuseWhileDraining(s.requireUnrestrictedAccount(s.createLobbyHandler)),
+		"POST /lobby/join":     s.refuseWhileDraining(s.requireUnrestrictedAccount(s.joinLobbyHandler)),
+		"GET /lobby/{id}/play": s.refuseWhileDraining(webSocketAuth(s.requireUnrestrictedAccount(s.handlePlayLobby))),
+	}
+}
+
+// The v1 routes plus the profile routes that predate /users/{username}, which
+// act on the caller's own account
+func (s *Server) unversionedRoutes() map[string]http.HandlerFunc {
+	routes := maps.Clone(s.v1Routes())
+	routes["GET /user/{$}"] = s.authMiddleware(successorLink(ownProfilePath(""), s.handleGetUser))
+	routes["POST /user/modify"] = s.authMiddleware(successorLink(ownProfilePath(""), s.handleModifyUser))
+	routes["POST /user/change-password"] = s.authMiddleware(successorLink(ownProfilePath("/password"), s.handleChangePassword))
+	return routes
+}
+
+// Announce the deprecation on every response, count each use in
+// deprecated_requests_total and log who still calls it, so we can tell when
+// the version is no longer called and can be removed. Each client is logged
+// once an hour per route, so busy ones do not flood the logs.
+func (d *apiDeprecation) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", d.since.Unix()))
+		w.Header().Set("Sunset", d.sunset.Format(http.TimeFormat))
+		w.Header().Set("Link", "<"+d.successor+r.URL.Path+`>; rel="successor-version"`)
+
+		deprecatedRequestsTotal.WithLabelValues(r.Pattern).Inc()
+		caller := deprecatedCaller{route: r.Pattern, ip: clientIP(r), userAgent: r.UserAgent()}
+		if d.firstCallInInterval(caller, time.Now()) {
+			slog.InfoContext(r.Context(), "Deprecated route called", "user_agent", caller.userAgent, "ip", caller.ip)
+		}
+
+		next(w, r)
+	}
+}
+
+// Record a call and report whether the caller has not been logged within
+// deprecationLogInterval. Entries older than that are dropped as new callers
+// come, so the map only holds the last interval's callers.
+func (d *apiDeprecation) firstCallInInterval(caller deprecatedCaller, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if last, ok := d.logged[caller]; ok && now.Sub(last) < deprecationLogInterval {
+		return false
+	}
+	if d.logged == nil {
+		d.logged = make(map[deprecatedCaller]time.Time)
+	}
+	maps.DeleteFunc(d.logged, func(_ deprecatedCaller, last time.Time) bool {
+		return now.Sub(last) >= deprecationLogInterval
+	})
+	d.logged[caller] = now
+	return true
+}
+
+// Point a deprecated route at a replacement with a different path than the
+// version prefix alone would give
+func successorLink(successor func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "<"+successor(r)+`>; rel="successor-version"`)
+		next(w, r)
+	}
+}
+
+// Successor of a deprecated route under the caller's /users/{username}
+func ownProfilePath(suffix string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return currentAPIPrefix + "/users/" + url.PathEscape(authenticatedUsername(r)) + suffix
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// Machine-readable error codes. Clients branch on the code; the message is
+// for people and may change.
+const (
+	codeInvalidRequest    = "invalid_request"   // the body could not be parsed
+	codeValidationFailed  = "validation_failed" // see the field details
+	codeUnauthorized      = "unauthorized"
+	codeForbidden         = "forbidden"
+	codeAccountRestricted = "account_restricted" // email or parental consent pending
+	codeNotFound          = "not_found"
+	codeConflict          = "conflict"
+	codeConcurrentUpdate  = "concurrent_update" // lost a race, retry
+	codeUsernameTaken     = "username_taken"
+	codeLobbyUnavailable  = "lobby_unavailable"
+	codeAlreadyInLobby    = "already_in_lobby"
+	codeRateLimited       = "rate_limited"
+	codeAccountLocked     = "account_locked"
+	codeShuttingDown      = "shutting_down" // retry shortly, against the restarted server
+	codeInternal          = "internal_error"
+)
+
+// Problem with one field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Body of every error response
+type APIError struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Details   []FieldError `json:"details,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+}
+
+// Header carrying the request ID, accepted from the client or generated
+const requestIDHeader = "X-Request-ID"
+
+// Request IDs accepted from clients; anything else is replaced
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Write a JSON response
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Write a success response that carries nothing but a message
+func writeMessage(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
+
+// Write an error response
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIError(w, status, APIError{Code: code, Message: message})
+}
+
+// Write a 400 naming the invalid fields. A single field's error doubles as
+// the overall message.
+func writeValidationError(w http.ResponseWriter, fields ...FieldError) {
+	message := fmt.Sprintf("%d fields are invalid", len(fields))
+	if len(fields) == 1 {
+		message = fields[0].Field + ": " + fields[0].Message
+	}
+	writeAPIError(w, http.StatusBadRequest, APIError{Code: codeValidationFailed, Message: message, Details: fields})
+}
+
+// The request ID is read back from the response header set by
+// requestIDMiddleware, so helpers without the request can still report it
+func writeAPIError(w http.ResponseWriter, status int, apiErr APIError) {
+	apiErr.RequestID = w.Header().Get(requestIDHeader)
+	writeJSON(w, status, apiErr)
+}
+
+// Give every request an ID, echoed in the X-Request-ID response header and in
+// error bodies and added to the request's log lines, so a report from a user
+// can be matched to the logs. A sane ID sent by the client or a proxy is kept.
+func requestIDMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, requestID)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+func newRequestID() string {
+	raw := make([]byte, 12)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
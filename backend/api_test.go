@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A server over a MemoryStore, called through its full handler chain
+type testAPI struct {
+	t       *testing.T
+	server  *Server
+	handler http.Handler
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	config := defaultConfig()
+	config.JWTSecret = "test-secret-test-secret-test-secret"
+	config.MetricsToken = "test-metrics-token"
+	server := NewServer(config, NewMemoryStore())
+	return &testAPI{t: t, server: server, handler: server.Handler()}
+}
+
+// Send a request with an optional bearer token and JSON body
+func (a *testAPI) do(method, path, token string, body any) *httptest.ResponseRecorder {
+	a.t.Helper()
+	var reader *bytes.Reader
+	switch body := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case string:
+		reader = bytes.NewReader([]byte(body))
+	default:
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			a.t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	request := httptest.NewRequest(method, path, reader)
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	a.handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// Decode a response body, failing the test unless the status is as expected
+func decodeResponse[T any](t *testing.T, recorder *httptest.ResponseRecorder, status int) T {
+	t.Helper()
+	var body T
+	if recorder.Code != status {
+		t.Fatalf("status %d, want %d; body %s", recorder.Code, status, recorder.Body)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %s: %v", recorder.Body, err)
+	}
+	return body
+}
+
+// Check an error response carries the envelope with the expected code
+func expectError(t *testing.T, recorder *httptest.ResponseRecorder, status int, code string) APIError {
+	t.Helper()
+	apiErr := decodeResponse[APIError](t, recorder, status)
+	if apiErr.Code != code {
+		t.Fatalf("error code %q, want %q; body %s", apiErr.Code, code, recorder.Body)
+	}
+	if apiErr.Message == "" {
+		t.Fatalf("error without a message: %s", recorder.Body)
+	}
+	if apiErr.RequestID == "" || apiErr.RequestID != recorder.Header().Get(requestIDHeader) {
+		t.Fatalf("error request ID %q, header %q", apiErr.RequestID, recorder.Header().Get(requestIDHeader))
+	}
+	return apiErr
+}
+
+func (a *testAPI) signUp(username string) {
+	a.t.Helper()
+	recorder := a.do("POST", "/api/v1/user/add", "", map[string]string{
+		"username": username,
+		"password": "password1",
+		"email":    username + "@example.com",
+		"dob":      "2000-01-01",
+	})
+	decodeResponse[map[string]string](a.t, recorder, http.StatusCreated)
+}
+
+// Follow the link in the last verification email sent to a user
+func (a *testAPI) verifyEmail(username string) {
+	a.t.Helper()
+	var token string
+	for _, email := range a.server.mailer.(*MemoryMailer).Sent() {
+		if email.To == username+"@example.com" && strings.Contains(email.Body, "/verify-email?token=") {
+			_, link, _ := strings.Cut(email.Body, "/verify-email?token=")
+			token, _ = url.QueryUnescape(strings.Fields(link)[0])
+		}
+	}
+	if token == "" {
+		a.t.Fatalf("no verification email for %s", username)
+	}
+	recorder := a.do("POST", "/api/v1/user/verify-email", "", map[string]string{"token": token})
+	decodeResponse[map[string]string](a.t, recorder, http.StatusOK)
+}
+
+func (a *testAPI) login(username string) TokenPair {
+	a.t.Helper()
+	recorder := a.do("POST", "/api/v1/user/login", "", map[string]string{"username": username, "password": "password1"})
+	return decodeResponse[struct{ Tokens TokenPair }](a.t, recorder, http.StatusOK).Tokens
+}
+
+// Sign up, verify the email and log in
+func (a *testAPI) player(username string) string {
+	a.t.Helper()
+	a.signUp(username)
+	a.verifyEmail(username)
+	return a.login(username).AccessToken
+}
+
+func (a *testAPI) setRole(username, role string) {
+	a.t.Helper()
+	_, err := a.server.updateUser(context.Background(), username, func(user *User) error {
+		user.Role = role
+		return nil
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+}
+
+func TestSignupLoginAndRefresh(t *testing.T) {
+	api := newTestAPI(t)
+	api.signUp("alice")
+
+	duplicate := api.do("POST", "/api/v1/user/add", "", map[string]string{
+		"username": "alice", "password": "password1", "email": "other@example.com", "dob": "2000-01-01",
+	})
+	expectError(t, duplicate, http.StatusConflict, codeUsernameTaken)
+
+	wrongPassword := api.do("POST", "/api/v1/user/login", "", map[string]string{"username": "alice", "password": "wrong-password"})
+	expectError(t, wrongPassword, http.StatusUnauthorized, codeUnauthorized)
+
+	tokens := api.login("alice")
+	if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("login returned tokens %+v", tokens)
+	}
+
+	profile := decodeResponse[map[string]any](t, api.do("GET", "/api/v1/users/alice", tokens.AccessToken, nil), http.StatusOK)
+	if profile["username"] != "alice" {
+		t.Fatalf("profile %v", profile)
+	}
+
+	refreshed := decodeResponse[TokenPair](t, api.do("POST", "/api/v1/user/refresh", "", map[string]string{"refreshToken": tokens.RefreshToken}), http.StatusOK)
+	if refreshed.AccessToken == "" || refreshed.RefreshToken == "" {
+		t.Fatalf("refresh returned tokens %+v", refreshed)
+	}
+
+	// An access token is not a refresh token
+	misused := api.do("POST", "/api/v1/user/refresh", "", map[string]string{"refreshToken": tokens.AccessToken})
+	expectError(t, misused, http.StatusUnauthorized, codeUnauthorized)
+
+	// Changing the password signs out the sessions issued before
+	changed := api.do("POST", "/api/v1/users/alice/password", tokens.AccessToken, map[string]string{
+		"currentPassword": "password1", "newPassword": "password2",
+	})
+	decodeResponse[map[string]any](t, changed, http.StatusOK)
+	revoked := api.do("POST", "/api/v1/user/refresh", "", map[string]string{"refreshToken": tokens.RefreshToken})
+	expectError(t, revoked, http.StatusUnauthorized, codeUnauthorized)
+}
+
+func TestRoleChecks(t *testing.T) {
+	api := newTestAPI(t)
+	api.signUp("admin")
+	api.signUp("student")
+	api.setRole("admin", RoleAdmin)
+	adminToken := api.login("admin").AccessToken
+	studentToken := api.login("student").AccessToken
+
+	expectError(t, api.do("GET", "/api/v1/users", "", nil), http.StatusUnauthorized, codeUnauthorized)
+	expectError(t, api.do("GET", "/api/v1/users", studentToken, nil), http.StatusForbidden, codeForbidden)
+	expectError(t, api.do("GET", "/api/v1/users/admin", studentToken, nil), http.StatusForbidden, codeForbidden)
+
+	users := decodeResponse[[]map[string]any](t, api.do("GET", "/api/v1/users", adminToken, nil), http.StatusOK)
+	if len(users) != 2 {
+		t.Fatalf("admin listed %d users, want 2", len(users))
+	}
+	decodeResponse[map[string]any](t, api.do("GET", "/api/v1/users/student", adminToken, nil), http.StatusOK)
+
+	invalid := api.do("POST", "/api/v1/user/role", adminToken, map[string]string{"username": "student", "role": "overlord"})
+	expectError(t, invalid, http.StatusBadRequest, codeValidationFailed)
+	self := api.do("POST", "/api/v1/user/role", adminToken, map[string]string{"username": "admin", "role": RoleStudent})
+	expectError(t, self, http.StatusForbidden, codeForbidden)
+
+	promoted := api.do("POST", "/api/v1/user/role", adminToken, map[string]string{"username": "student", "role": RoleTeacher})
+	decodeResponse[map[string]string](t, promoted, http.StatusOK)
+	// The role change signs the user out, so the new role applies at once
+	expectError(t, api.do("GET", "/api/v1/users/student", studentToken, nil), http.StatusUnauthorized, codeUnauthorized)
+	profile := decodeResponse[map[string]any](t, api.do("GET", "/api/v1/users/student", api.login("student").AccessToken, nil), http.StatusOK)
+	if profile["role"] != RoleTeacher {
+		t.Fatalf("role after promotion %v, want %s", profile["role"], RoleTeacher)
+	}
+}
+
+func TestLobbyCreateAndJoin(t *testing.T) {
+	api := newTestAPI(t)
+	api.signUp("unverified")
+	unverified := api.login("unverified").AccessToken
+	expectError(t, api.do("GET", "/api/v1/lobbies", unverified, nil), http.StatusForbidden, codeAccountRestricted)
+
+	creator := api.player("creator")
+	joiner := api.player("joiner")
+	latecomer := api.player("latecomer")
+
+	invalid := api.do("POST", "/api/v1/lobby/create", creator, map[string]any{"questions": []any{}})
+	expectError(t, invalid, http.StatusBadRequest, codeValidationFailed)
+
+	created := decodeResponse[Lobby](t, api.do("POST", "/api/v1/lobby/create", creator, map[string]any{
+		"questions": []map[string]any{
+			{"questionText": "2 + 2", "options": []string{"3", "4"}, "correctAnswer": "4"},
+		},
+	}), http.StatusCreated)
+	if created.Status != "waiting" || created.Creator != "creator" || len(created.Participants) != 1 {
+		t.Fatalf("created lobby %+v", created)
+	}
+	if created.Questions[0].CorrectAnswer != "" {
+		t.Fatal("created lobby shows the correct answer")
+	}
+
+	waiting := decodeResponse[[]Lobby](t, api.do("GET", "/api/v1/lobbies", joiner, nil), http.StatusOK)
+	if len(waiting) != 1 || waiting[0].ID != created.ID {
+		t.Fatalf("waiting lobbies %+v", waiting)
+	}
+
+	expectError(t, api.do("POST", "/api/v1/lobby/join", joiner, map[string]string{}), http.StatusBadRequest, codeValidationFailed)
+	expectError(t, api.do("POST", "/api/v1/lobby/join", joiner, map[string]string{"lobby_id": "missing"}), http.StatusNotFound, codeNotFound)
+	expectError(t, api.do("POST", "/api/v1/lobby/join", creator, map[string]string{"lobby_id": created.ID}), http.StatusConflict, codeAlreadyInLobby)
+
+	joined := decodeResponse[struct{ Lobby Lobby }](t, api.do("POST", "/api/v1/lobby/join", joiner, map[string]string{"lobby_id": created.ID}), http.StatusOK)
+	if joined.Lobby.Status != "active" || len(joined.Lobby.Participants) != lobbyCapacity {
+		t.Fatalf("joined lobby %+v", joined.Lobby)
+	}
+	if joined.Lobby.Questions[0].CorrectAnswer != "" {
+		t.Fatal("joined lobby shows the correct answer")
+	}
+
+	expectError(t, api.do("POST", "/api/v1/lobby/join", latecomer, map[string]string{"lobby_id": created.ID}), http.StatusForbidden, codeLobbyUnavailable)
+	if waiting := decodeResponse[[]Lobby](t, api.do("GET", "/api/v1/lobbies", latecomer, nil), http.StatusOK); len(waiting) != 0 {
+		t.Fatalf("full lobby still listed as waiting: %+v", waiting)
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	api := newTestAPI(t)
+
+	malformed := api.do("POST", "/api/v1/user/login", "", "{not json")
+	expectError(t, malformed, http.StatusBadRequest, codeInvalidRequest)
+
+	// Every invalid field is reported at once
+	signup := api.do("POST", "/api/v1/user/add", "", map[string]string{"username": "x", "email": "not-an-email"})
+	apiErr := expectError(t, signup, http.StatusBadRequest, codeValidationFailed)
+	fields := make(map[string]bool)
+	for _, detail := range apiErr.Details {
+		fields[detail.Field] = true
+	}
+	for _, field := range []string{"username", "email", "password", "dob"} {
+		if !fields[field] {
+			t.Errorf("no detail for %s in %+v", field, apiErr.Details)
+		}
+	}
+
+	// A sane request ID from the client is echoed; anything else is replaced
+	request := httptest.NewRequest("GET", "/api/v1/users", nil)
+	request.Header.Set(requestIDHeader, "client-id-1")
+	recorder := httptest.NewRecorder()
+	api.handler.ServeHTTP(recorder, request)
+	if apiErr := expectError(t, recorder, http.StatusUnauthorized, codeUnauthorized); apiErr.RequestID != "client-id-1" {
+		t.Fatalf("request ID %q, want the client's", apiErr.RequestID)
+	}
+
+	request = httptest.NewRequest("GET", "/api/v1/users", nil)
+	request.Header.Set(requestIDHeader, "bad id with spaces")
+	recorder = httptest.NewRecorder()
+	api.handler.ServeHTTP(recorder, request)
+	if apiErr := expectError(t, recorder, http.StatusUnauthorized, codeUnauthorized); apiErr.RequestID == "bad id with spaces" {
+		t.Fatal("an invalid request ID was echoed")
+	}
+
+	expectError(t, api.do("GET", "/metrics", "", nil), http.StatusUnauthorized, codeUnauthorized)
+}
+
+func TestMetricsOnlyServedWithToken(t *testing.T) {
+	api := newTestAPI(t)
+	expectError(t, api.do("GET", "/metrics", "wrong-token", nil), http.StatusUnauthorized, codeUnauthorized)
+	if recorder := api.do("GET", "/metrics", "test-metrics-token", nil); recorder.Code != http.StatusOK {
+		t.Fatalf("metrics with the token: status %d", recorder.Code)
+	}
+
+	config := defaultConfig()
+	config.JWTSecret = "test-secret-test-secret-test-secret"
+	config.Storage.Backend = "memory"
+	if err := config.validate(true); err != nil {
+		t.Fatalf("config without a metrics token: %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	NewServer(config, NewMemoryStore()).Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("metrics without a configured token: status %d, want 404", recorder.Code)
+	}
+}
+
+func TestDeprecatedCallsLoggedOncePerClient(t *testing.T) {
+	var d apiDeprecation
+	now := time.Now()
+	caller := deprecatedCaller{route: "POST /user/login", ip: "192.0.2.1", userAgent: "app/1.0"}
+	other := deprecatedCaller{route: "POST /user/login", ip: "192.0.2.2", userAgent: "app/1.0"}
+
+	if !d.firstCallInInterval(caller, now) {
+		t.Fatal("first call not logged")
+	}
+	if d.firstCallInInterval(caller, now.Add(time.Minute)) {
+		t.Fatal("repeated call logged within the interval")
+	}
+	if !d.firstCallInInterval(other, now.Add(time.Minute)) {
+		t.Fatal("another client's call not logged")
+	}
+	if !d.firstCallInInterval(caller, now.Add(deprecationLogInterval)) {
+		t.Fatal("call not logged again after the interval")
+	}
+}
+
+func TestTwoFactorDisableCountsWrongPasswords(t *testing.T) {
+	api := newTestAPI(t)
+	api.signUp("alice")
+	token := api.login("alice").AccessToken
+
+	enrollment := decodeResponse[map[string]string](t, api.do("POST", "/api/v1/user/2fa/enroll", token, nil), http.StatusOK)
+	code, err := totpCode(enrollment["secret"], time.Now().Unix()/int64(totpPeriod.Seconds()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirmed := decodeResponse[struct{ Tokens TokenPair }](t, api.do("POST", "/api/v1/user/2fa/confirm", token, map[string]string{"code": code}), http.StatusOK)
+	token = confirmed.Tokens.AccessToken
+
+	wrong := map[string]string{"password": "wrong-password", "code": "000000"}
+	for range maxFailedLoginAttempts - 1 {
+		expectError(t, api.do("POST", "/api/v1/user/2fa/disable", token, wrong), http.StatusUnauthorized, codeUnauthorized)
+	}
+	expectError(t, api.do("POST", "/api/v1/user/2fa/disable", token, wrong), http.StatusLocked, codeAccountLocked)
+
+	// The right password is refused too until the lockout ends
+	right := map[string]string{"password": "password1", "code": "000000"}
+	expectError(t, api.do("POST", "/api/v1/user/2fa/disable", token, right), http.StatusLocked, codeAccountLocked)
+}
+
+func TestLoginClearsFailuresFromTheAddress(t *testing.T) {
+	api := newTestAPI(t)
+	api.signUp("alice")
+	api.signUp("bob")
+
+	// Users behind one address mistype now and then, and log in in between
+	for round := range maxFailedLoginsPerIP {
+		username := []string{"alice", "bob"}[round%2]
+		wrong := api.do("POST", "/api/v1/user/login", "", map[string]string{"username": username, "password": "typo"})
+		expectError(t, wrong, http.StatusUnauthorized, codeUnauthorized)
+		api.login(username)
+	}
+
+	// Without a successful login, the address is blocked at the limit
+	for range maxFailedLoginsPerIP {
+		api.do("POST", "/api/v1/user/login", "", map[string]string{"username": "nobody", "password": "guess"})
+	}
+	blocked := api.do("POST", "/api/v1/user/login", "", map[string]string{"username": "alice", "password": "password1"})
+	expectError(t, blocked, http.StatusTooManyRequests, codeRateLimited)
+}
+
+func TestForgotPasswordIsRateLimited(t *testing.T) {
+	api := newTestAPI(t)
+	api.signUp("alice")
+
+	resetEmails := func() int {
+		count := 0
+		for _, email := range api.server.mailer.(*MemoryMailer).Sent() {
+			if strings.Contains(email.Body, "/reset-password?token=") {
+				count++
+			}
+		}
+		return count
+	}
+
+	// Past its limit an account gets the usual response but no more email
+	for range maxResetEmailsPerAccount + 2 {
+		recorder := api.do("POST", "/api/v1/user/forgot-password", "", map[string]string{"username": "alice"})
+		decodeResponse[map[string]string](t, recorder, http.StatusAccepted)
+	}
+	if sent := resetEmails(); sent != maxResetEmailsPerAccount {
+		t.Fatalf("%d reset emails sent, want %d", sent, maxResetEmailsPerAccount)
+	}
+
+	// The address is refused once it reaches its own limit
+	for range maxResetRequestsPerIP - maxResetEmailsPerAccount - 2 {
+		recorder := api.do("POST", "/api/v1/user/forgot-password", "", map[string]string{"username": "nobody"})
+		decodeResponse[map[string]string](t, recorder, http.StatusAccepted)
+	}
+	blocked := api.do("POST", "/api/v1/user/forgot-password", "", map[string]string{"username": "nobody"})
+	expectError(t, blocked, http.StatusTooManyRequests, codeRateLimited)
+	if blocked.Header().Get("Retry-After") == "" {
+		t.Fatal("no Retry-After header")
+	}
+}
+
+func TestConfigRequiresLongJWTSecret(t *testing.T) {
+	config := defaultConfig()
+	config.Storage.Backend = "memory"
+	config.JWTSecret = strings.Repeat("x", minJWTSecretLength-1)
+	if err := config.validate(true); err == nil || !strings.Contains(err.Error(), "JWT_SECRET") {
+		t.Fatalf("short secret accepted: %v", err)
+	}
+	config.JWTSecret = strings.Repeat("x", minJWTSecretLength)
+	if err := config.validate(true); err != nil {
+		t.Fatalf("secret of %d bytes rejected: %v", minJWTSecretLength, err)
+	}
+}
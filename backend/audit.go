@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Audit actions
+const (
+	auditLoginSucceeded         = "login.succeeded"
+	auditLoginFailed            = "login.failed"
+	auditPasswordChanged        = "password.changed"
+	auditPasswordResetRequested = "password.reset_requested"
+	auditPasswordReset          = "password.reset"
+	auditProfileUpdated         = "profile.updated"
+	auditRoleChanged            = "role.changed"
+	auditEmailVerified          = "email.verified"
+	auditParentalConsentGranted = "parental_consent.granted"
+	auditLobbyCreated           = "lobby.created"
+	auditAccountLocked          = "account.locked"
+	auditLoginRateLimited       = "login.rate_limited"
+	auditTwoFactorEnabled       = "2fa.enabled"
+	auditTwoFactorDisabled      = "2fa.disabled"
+	auditRecoveryCodeUsed       = "2fa.recovery_code_used"
+	auditDeletionRequested      = "account.deletion_requested"
+	auditDeletionCancelled      = "account.deletion_cancelled"
+	auditAccountDeleted         = "account.deleted"
+)
+
+const (
+	defaultAuditQueryLimit = 100
+	maxAuditQueryLimit     = 1000
+)
+
+// An entry in the append-only audit collection. Events are only ever
+// inserted; nothing in the API updates or deletes them.
+type AuditEvent struct {
+	Actor     string            `json:"actor"`  // username performing the action, empty if anonymous
+	Action    string            `json:"action"` // one of the audit* constants
+	Target    string            `json:"target"` // username or resource acted upon
+	IP        string            `json:"ip"`
+	UserAgent string            `json:"userAgent"`
+	Timestamp time.Time         `json:"timestamp"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// Append an event to the audit log. Failures are logged rather than returned
+// so that auditing never breaks the request being audited.
+func (s *Server) recordAudit(r *http.Request, actor, action, target string, details map[string]string) {
+	event := AuditEvent{
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Timestamp: time.Now(),
+		Details:   details,
+	}
+
+	s.insertAuditEvent(r.Context(), event)
+}
+
+// Append an event raised by the server itself rather than by a request
+func (s *Server) recordSystemAudit(ctx context.Context, action, target string, details map[string]string) {
+	s.insertAuditEvent(ctx, AuditEvent{
+		Actor:     "system",
+		Action:    action,
+		Target:    target,
+		Timestamp: time.Now(),
+		Details:   details,
+	})
+}
+
+// The event is written even when ctx is cancelled, e.g. by the client
+// hanging up; ctx still adds the request's details to the log line
+func (s *Server) insertAuditEvent(ctx context.Context, event AuditEvent) {
+	ctx = context.WithoutCancel(ctx)
+	if err := s.auditLog.AppendAuditEvent(ctx, event); err != nil {
+		slog.ErrorContext(ctx, "Failed to write audit event", "action", event.Action, "target", event.Target, "error", err)
+	}
+}
+
+// Query the audit log (admin only). Supported query parameters:
+//
+//	user   events where the user is the actor or the target
+//	action only events with this action
+//	from   earliest timestamp, RFC 3339 or YYYY-MM-DD
+//	to     latest timestamp, RFC 3339 or YYYY-MM-DD (inclusive day)
+//	limit  maximum number of events, newest first
+func (s *Server) auditLogHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	auditQuery := AuditQuery{
+		User:   query.Get("user"),
+		Action: query.Get("action"),
+		Limit:  defaultAuditQueryLimit,
+	}
+
+	if from := query.Get("from"); from != "" {
+		t, err := parseAuditTime(from, false)
+		if err != nil {
+			writeValidationError(w, FieldError{Field: "from", Message: "Should be RFC 3339 or YYYY-MM-DD"})
+			return
+		}
+		auditQuery.From = t
+	}
+	if to := query.Get("to"); to != "" {
+		t, err := parseAuditTime(to, true)
+		if err != nil {
+			writeValidationError(w, FieldError{Field: "to", Message: "Should be RFC 3339 or YYYY-MM-DD"})
+			return
+		}
+		auditQuery.To = t
+	}
+
+	if limitParam := query.Get("limit"); limitParam != "" {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed < 1 {
+			writeValidationError(w, FieldError{Field: "limit", Message: "Should be a positive number"})
+			return
+		}
+		auditQuery.Limit = min(parsed, maxAuditQueryLimit)
+	}
+
+	events, err := s.auditLog.QueryAuditEvents(r.Context(), auditQuery)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve audit events")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
+
+// Parse an audit query time. A bare date as the end of a range means the
+// whole of that day.
+func parseAuditTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
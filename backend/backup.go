@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"time"
+)
+
+// Layout version written in the archive header
+const backupFormatVersion = 1
+
+// Longest line accepted when reading an archive; a lobby with all its
+// questions is the largest record
+const maxBackupLineSize = 16 << 20
+
+// Record types in an archive, in the order they are written
+const (
+	backupHeaderType  = "header"
+	backupUserType    = "user"
+	backupLobbyType   = "lobby"
+	backupConsentType = "consent"
+	backupAuditType   = "audit"
+	backupTrailerType = "trailer"
+)
+
+// A backup archive is JSON lines: a header, one line per record and a trailer
+// holding the record counts and a SHA-256 checksum of every line before it
+type backupLine struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type backupHeader struct {
+	FormatVersion       int       `json:"formatVersion"`
+	CreatedAt           time.Time `json:"createdAt"`
+	IncludesCredentials bool      `json:"includesCredentials"`
+}
+
+type backupTrailer struct {
+	Counts   map[string]int `json:"counts"`
+	Checksum string         `json:"checksum"`
+}
+
+// A user as archived. The password hash and two-factor settings are only
+// written when credentials are included; otherwise users who had two-factor
+// authentication are flagged, so the restore can name them.
+type backupUser struct {
+	User
+	PasswordHash     string             `json:"passwordHash,omitempty"`
+	TwoFactor        *TwoFactorSettings `json:"twoFactor,omitempty"`
+	TwoFactorDropped bool               `json:"twoFactorDropped,omitempty"`
+	TokenVersion     int                `json:"tokenVersion,omitempty"`
+}
+
+// The records of a verified archive
+type backupContents struct {
+	Header   backupHeader
+	Users    []User
+	Lobbies  []Lobby
+	Consents []ConsentRecord
+	Audit    []AuditEvent // oldest first
+	Checksum string       // from the trailer, identifying the archive
+
+	// Users whose two-factor settings were left out of the archive
+	TwoFactorDropped []string
+}
+
+func (c backupContents) String() string {
+	return fmt.Sprintf("%d users, %d lobbies, %d consent records and %d audit events",
+		len(c.Users), len(c.Lobbies), len(c.Consents), len(c.Audit))
+}
+
+// Stores that can run several calls in one transaction, so a restore is all
+// or nothing and a backup reads one snapshot
+type transactionalStore interface {
+	withTransaction(ctx context.Context, readOnly bool, fn func(ctx context.Context, store Store) error) error
+}
+
+// Stores without transactions over many records. Reads can share a snapshot,
+// and a restore records how far it got so that running it again resumes it.
+type resumableRestoreStore interface {
+	withSnapshot(ctx context.Context, fn func(ctx context.Context) error) error
+	// The checksum of the archive being restored and the records written so
+	// far, or "" if no restore is under way
+	restoreProgress(ctx context.Context) (string, int, error)
+	saveRestoreProgress(ctx context.Context, checksum string, done int) error
+	clearRestoreProgress(ctx context.Context) error
+}
+
+// Writes archive lines, keeping the running checksum and counts
+type backupWriter struct {
+	out      *bufio.Writer
+	checksum hash.Hash
+	counts   map[string]int
+}
+
+func (b *backupWriter) write(recordType string, record any) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(backupLine{Type: recordType, Data: data})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	b.checksum.Write(line)
+	if recordType != backupHeaderType {
+		b.counts[recordType]++
+	}
+	_, err = b.out.Write(line)
+	return err
+}
+
+// Write every user, lobby, consent record and audit event to an archive.
+// Password hashes and two-factor secrets are left out unless
+// includeCredentials is set.
+func writeBackup(ctx context.Context, store Store, w io.Writer, includeCredentials bool) (backupContents, error) {
+	contents := backupContents{
+		Header: backupHeader{
+			FormatVersion:       backupFormatVersion,
+			CreatedAt:           time.Now(),
+			IncludesCredentials: includeCredentials,
+		},
+	}
+
+	read := func(ctx context.Context, store Store) error {
+		var err error
+		if contents.Users, err = store.ListUsers(ctx); err != nil {
+			return err
+		}
+		if contents.Lobbies, err = store.ListLobbies(ctx); err != nil {
+			return err
+		}
+		if contents.Consents, err = store.ListConsentRecords(ctx, ""); err != nil {
+			return err
+		}
+		contents.Audit, err = store.QueryAuditEvents(ctx, AuditQuery{})
+		return err
+	}
+
+	// Read all four collections as of the same moment, so the archive never
+	// has a lobby whose creator is missing or an event for a user added later
+	var err error
+	switch snapshotter := store.(type) {
+	case transactionalStore:
+		err = snapshotter.withTransaction(ctx, true, read)
+	case resumableRestoreStore:
+		err = snapshotter.withSnapshot(ctx, func(ctx context.Context) error { return read(ctx, store) })
+	default:
+		err = read(ctx, store)
+	}
+	if err != nil {
+		return contents, err
+	}
+	// Restoring appends events in archive order
+	slices.Reverse(contents.Audit)
+
+	b := &backupWriter{out: bufio.NewWriter(w), checksum: sha256.New(), counts: make(map[string]int)}
+	if err := b.write(backupHeaderType, contents.Header); err != nil {
+		return contents, err
+	}
+	for _, user := range contents.Users {
+		record := backupUser{User: user, TokenVersion: user.TokenVersion}
+		if includeCredentials {
+			record.PasswordHash = user.PasswordHash
+			record.TwoFactor = &user.TwoFactor
+		} else if user.TwoFactor.Enabled {
+			record.TwoFactorDropped = true
+			contents.TwoFactorDropped = append(contents.TwoFactorDropped, user.Username)
+		}
+		if err := b.write(backupUserType, record); err != nil {
+			return contents, err
+		}
+	}
+	for _, lobby := range contents.Lobbies {
+		if err := b.write(backupLobbyType, lobby); err != nil {
+			return contents, err
+		}
+	}
+	for _, consent := range contents.Consents {
+		if err := b.write(backupConsentType, consent); err != nil {
+			return contents, err
+		}
+	}
+	for _, event := range contents.Audit {
+		if err := b.write(backupAuditType, event); err != nil {
+			return contents, err
+		}
+	}
+
+	trailer := backupTrailer{Counts: b.counts, Checksum: hex.EncodeToString(b.checksum.Sum(nil))}
+	if err := b.write(backupTrailerType, trailer); err != nil {
+		return contents, err
+	}
+	contents.Checksum = trailer.Checksum
+	return contents, b.out.Flush()
+}
+
+// Read an archive, checking its checksum, record counts and that usernames
+// and lobby IDs are present and unique. Fails unless the whole archive is
+// intact.
+func readBackup(r io.Reader) (backupContents, error) {
+	var contents backupContents
+	checksum := sha256.New()
+	counts := make(map[string]int)
+	var trailer *backupTrailer
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxBackupLineSize)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if trailer != nil {
+			return contents, fmt.Errorf("line %d: data after the trailer", lineNumber)
+		}
+
+		var line backupLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return contents, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if lineNumber == 1 && line.Type != backupHeaderType {
+			return contents, errors.New("not a backup archive: the first line is not a header")
+		}
+		if line.Type != backupTrailerType {
+			checksum.Write(scanner.Bytes())
+			checksum.Write([]byte{'\n'})
+		}
+		if line.Type != backupHeaderType && line.Type != backupTrailerType {
+			counts[line.Type]++
+		}
+
+		var err error
+		switch line.Type {
+		case backupHeaderType:
+			if lineNumber != 1 {
+				return contents, fmt.Errorf("line %d: unexpected second header", lineNumber)
+			}
+			if err = json.Unmarshal(line.Data, &contents.Header); err == nil && contents.Header.FormatVersion != backupFormatVersion {
+				return contents, fmt.Errorf("unsupported archive format version %d, expected %d", contents.Header.FormatVersion, backupFormatVersion)
+			}
+		case backupUserType:
+			var record backupUser
+			if err = json.Unmarshal(line.Data, &record); err == nil {
+				user := record.User
+				user.PasswordHash = record.PasswordHash
+				user.TokenVersion = record.TokenVersion
+				if record.TwoFactor != nil {
+					user.TwoFactor = *record.TwoFactor
+				}
+				if record.TwoFactorDropped {
+					contents.TwoFactorDropped = append(contents.TwoFactorDropped, user.Username)
+				}
+				contents.Users = append(contents.Users, user)
+			}
+		case backupLobbyType:
+			var lobby Lobby
+			if err = json.Unmarshal(line.Data, &lobby); err == nil {
+				contents.Lobbies = append(contents.Lobbies, lobby)
+			}
+		case backupConsentType:
+			var consent ConsentRecord
+			if err = json.Unmarshal(line.Data, &consent); err == nil {
+				contents.Consents = append(contents.Consents, consent)
+			}
+		case backupAuditType:
+			var event AuditEvent
+			if err = json.Unmarshal(line.Data, &event); err == nil {
+				contents.Audit = append(contents.Audit, event)
+			}
+		case backupTrailerType:
+			trailer = &backupTrailer{}
+			err = json.Unmarshal(line.Data, trailer)
+		default:
+			return contents, fmt.Errorf("line %d: unknown record type %q", lineNumber, line.Type)
+		}
+		if err != nil {
+			return contents, fmt.Errorf("line %d: invalid %s record: %w", lineNumber, line.Type, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return contents, err
+	}
+
+	if lineNumber == 0 {
+		return contents, errors.New("archive is empty")
+	}
+	if trailer == nil {
+		return contents, errors.New("archive is truncated: the trailer is missing")
+	}
+	if hex.EncodeToString(checksum.Sum(nil)) != trailer.Checksum {
+		return contents, errors.New("checksum mismatch: the archive was modified or corrupted")
+	}
+	if !maps.Equal(counts, trailer.Counts) {
+		return contents, fmt.Errorf("record counts %v do not match the trailer %v", counts, trailer.Counts)
+	}
+	contents.Checksum = trailer.Checksum
+
+	usernames := make(map[string]bool)
+	for _, user := range contents.Users {
+		if user.Username == "" {
+			return contents, errors.New("archive has a user without a username")
+		}
+		if usernames[user.Username] {
+			return contents, fmt.Errorf("archive has user %s more than once", user.Username)
+		}
+		usernames[user.Username] = true
+	}
+	lobbyIDs := make(map[string]bool)
+	for _, lobby := range contents.Lobbies {
+		if lobby.ID == "" {
+			return contents, errors.New("archive has a lobby without an ID")
+		}
+		if lobbyIDs[lobby.ID] {
+			return contents, fmt.Errorf("archive has lobby %s more than once", lobby.ID)
+		}
+		lobbyIDs[lobby.ID] = true
+	}
+	return contents, nil
+}
+
+// Refuse to restore over existing data, which the archive would partly
+// duplicate and partly conflict with
+func checkStoreEmpty(ctx context.Context, store Store) error {
+	users, err := store.ListUsers(ctx)
+	if err != nil {
+		return err
+	}
+	lobbies, err := store.ListLobbies(ctx)
+	if err != nil {
+		return err
+	}
+	consents, err := store.ListConsentRecords(ctx, "")
+	if err != nil {
+		return err
+	}
+	events, err := store.QueryAuditEvents(ctx, AuditQuery{Limit: 1})
+	if err != nil {
+		return err
+	}
+
+	if len(users) > 0 || len(lobbies) > 0 || len(consents) > 0 || len(events) > 0 {
+		return fmt.Errorf("the store already has data (%d users, %d lobbies, %d consent records, audit events: %t); restore only into an empty store",
+			len(users), len(lobbies), len(consents), len(events) > 0)
+	}
+	return nil
+}
+
+// Write the records of a verified archive to an empty store, or resume an
+// interrupted restore of the same archive that already wrote the first done
+// records. A store with transactions is restored in one, so a failure leaves
+// it empty; any other keeps its progress after every record.
+func restoreBackup(ctx context.Context, store Store, contents backupContents, done int) error {
+	switch restorer := store.(type) {
+	case transactionalStore:
+		err := restorer.withTransaction(ctx, false, func(ctx context.Context, store Store) error {
+			return writeBackupRecords(ctx, store, contents, 0, nil)
+		})
+		if err != nil {
+			return fmt.Errorf("restore failed and nothing was written: %w", err)
+		}
+		return nil
+	case resumableRestoreStore:
+		if err := restorer.saveRestoreProgress(ctx, contents.Checksum, done); err != nil {
+			return err
+		}
+		err := writeBackupRecords(ctx, store, contents, done, func(done int) error {
+			return restorer.saveRestoreProgress(ctx, contents.Checksum, done)
+		})
+		if err != nil {
+			return fmt.Errorf("restore stopped part way, run it again with the same archive to resume: %w", err)
+		}
+		return restorer.clearRestoreProgress(ctx)
+	default:
+		if err := writeBackupRecords(ctx, store, contents, 0, nil); err != nil {
+			return fmt.Errorf("restore failed part way, empty the store before retrying: %w", err)
+		}
+		return nil
+	}
+}
+
+// Restoring one archive record
+type restoreStep struct {
+	name string
+	// Whether the record is already in the store, checked for the record a
+	// resumable restore starts with, which an interrupted attempt may have
+	// written without recording its progress
+	written func(ctx context.Context, store Store) (bool, error)
+	write   func(ctx context.Context, store Store) error
+}
+
+// Write the records of an archive in archive order, skipping the first skip.
+// progress, if set, is called with the number of records written after each,
+// and the first record written is looked up first in case an earlier attempt
+// wrote it.
+func writeBackupRecords(ctx context.Context, store Store, contents backupContents, skip int, progress func(done int) error) error {
+	steps := restoreSteps(contents)
+	for i := skip; i < len(steps); i++ {
+		step := steps[i]
+		if i == skip && progress != nil {
+			written, err := step.written(ctx, store)
+			if err != nil {
+				return fmt.Errorf("%s: %w", step.name, err)
+			}
+			if written {
+				continue
+			}
+		}
+		if err := step.write(ctx, store); err != nil {
+			return fmt.Errorf("%s: %w", step.name, err)
+		}
+		if progress != nil {
+			if err := progress(i + 1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func restoreSteps(contents backupContents) []restoreStep {
+	var steps []restoreStep
+	for _, user := range contents.Users {
+		steps = append(steps, restoreStep{
+			name: "user " + user.Username,
+			written: func(ctx context.Context, store Store) (bool, error) {
+				return found(store.GetUser(ctx, user.Username))
+			},
+			write: func(ctx context.Context, store Store) error { return store.CreateUser(ctx, user) },
+		})
+	}
+	for _, lobby := range contents.Lobbies {
+		steps = append(steps, restoreStep{
+			name: "lobby " + lobby.ID,
+			written: func(ctx context.Context, store Store) (bool, error) {
+				return found(store.GetLobby(ctx, lobby.ID))
+			},
+			write: func(ctx context.Context, store Store) error { return store.CreateLobby(ctx, lobby) },
+		})
+	}
+	for _, consent := range contents.Consents {
+		steps = append(steps, restoreStep{
+			name: "consent record for " + consent.Username,
+			written: func(ctx context.Context, store Store) (bool, error) {
+				records, err := store.ListConsentRecords(ctx, consent.Username)
+				return slices.ContainsFunc(records, func(record ConsentRecord) bool {
+					return record.ParentEmail == consent.ParentEmail && record.GrantedAt.Equal(consent.GrantedAt)
+				}), err
+			},
+			write: func(ctx context.Context, store Store) error { return store.AddConsentRecord(ctx, consent) },
+		})
+	}
+	for _, event := range contents.Audit {
+		steps = append(steps, restoreStep{
+			name: fmt.Sprintf("audit event %s at %s", event.Action, event.Timestamp.Format(time.RFC3339)),
+			written: func(ctx context.Context, store Store) (bool, error) {
+				events, err := store.QueryAuditEvents(ctx, AuditQuery{Action: event.Action, From: event.Timestamp, To: event.Timestamp})
+				return slices.ContainsFunc(events, func(stored AuditEvent) bool {
+					return stored.Actor == event.Actor && stored.Target == event.Target
+				}), err
+			},
+			write: func(ctx context.Context, store Store) error { return store.AppendAuditEvent(ctx, event) },
+		})
+	}
+	return steps
+}
+
+// Whether a lookup found its record
+func found[T any](_ T, err error) (bool, error) {
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Write an archive of the store to a file or standard output
+func runBackupCommand(ctx context.Context, store Store, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	path := flags.String("file", "", "archive to write, or - for standard output")
+	includeCredentials := flags.Bool("include-credentials", false, "include password hashes and two-factor secrets")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return errors.New("backup: -file is required")
+	}
+
+	out := os.Stdout
+	if *path != "-" {
+		file, err := os.OpenFile(*path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	contents, err := writeBackup(ctx, store, out, *includeCredentials)
+	if err != nil {
+		if *path != "-" {
+			os.Remove(*path)
+		}
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	if *path != "-" {
+		if err := out.Sync(); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Backed up", "contents", contents.String())
+	if !*includeCredentials {
+		slog.Warn("Password hashes and two-factor secrets were left out; restored users will need to reset their passwords")
+	}
+	warnTwoFactorDropped(contents)
+	return nil
+}
+
+// Check an archive and load it into an empty store
+func runRestoreCommand(ctx context.Context, store Store, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	path := flags.String("file", "", "archive to read, or - for standard input")
+	dryRun := flags.Bool("dry-run", false, "verify the archive and the store without writing anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return errors.New("restore: -file is required")
+	}
+
+	in := os.Stdin
+	if *path != "-" {
+		file, err := os.Open(*path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	contents, err := readBackup(in)
+	if err != nil {
+		return fmt.Errorf("invalid archive: %w", err)
+	}
+
+	// An interrupted restore of this archive is resumed rather than refused
+	// for the data it already wrote
+	resuming, done := false, 0
+	if restorer, ok := store.(resumableRestoreStore); ok {
+		checksum, written, err := restorer.restoreProgress(ctx)
+		if err != nil {
+			return err
+		}
+		if checksum != "" && checksum != contents.Checksum {
+			return errors.New("a restore of a different archive was interrupted; drop the database before restoring this one")
+		}
+		resuming, done = checksum != "", written
+	}
+	if !resuming {
+		if err := checkStoreEmpty(ctx, store); err != nil {
+			return err
+		}
+	}
+
+	if resuming {
+		slog.Info("Resuming an interrupted restore", "already_restored", done)
+	}
+	if *dryRun {
+		slog.Info("Dry run: the archive is intact and would be restored", "created_at", contents.Header.CreatedAt.Format(time.RFC3339), "contents", contents.String())
+		return nil
+	}
+	if err := restoreBackup(ctx, store, contents, done); err != nil {
+		return err
+	}
+
+	slog.Info("Restored", "contents", contents.String())
+	if !contents.Header.IncludesCredentials {
+		slog.Warn("The archive has no credentials; restored users must reset their passwords")
+	}
+	warnTwoFactorDropped(contents)
+	return nil
+}
+
+// Name the users whose two-factor authentication an archive without
+// credentials left out. They can sign in with a password alone once restored,
+// until they enrol again.
+func warnTwoFactorDropped(contents backupContents) {
+	if len(contents.TwoFactorDropped) > 0 {
+		slog.Warn("Two-factor authentication was left out for some users, who must enrol again once restored",
+			"count", len(contents.TwoFactorDropped), "users", contents.TwoFactorDropped)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Address of the client, worked out once per request by clientIPMiddleware
+const clientIPContextKey contextKey = "client_ip"
+
+// Parse a trusted proxy given as an IP address or a CIDR range
+func parseTrustedProxy(value string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.ParsePrefix(value)
+}
+
+// Trusted proxies of a validated config
+func parseTrustedProxies(values []string) []netip.Prefix {
+	proxies := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if proxy, err := parseTrustedProxy(value); err == nil {
+			proxies = append(proxies, proxy.Masked())
+		}
+	}
+	return proxies
+}
+
+// Middleware recording the client's address in the request context, for the
+// audit trail, the login throttle and the logs
+func (s *Server) clientIPMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey, s.resolveClientIP(r))
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// The peer of the connection, unless it is a trusted proxy. Then the
+// X-Forwarded-For entries are read from the right, skipping the trusted
+// proxies, since only the entries they appended can be believed; the first
+// other address is the client.
+func (s *Server) resolveClientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !s.isTrustedProxy(ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for _, entry := range slices.Backward(forwarded) {
+		addr, err := netip.ParseAddr(strings.TrimSpace(entry))
+		if err != nil {
+			// Anything further left was written by whoever sent the garbage
+			break
+		}
+		ip = addr.Unmap().String()
+		if !s.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func (s *Server) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return slices.ContainsFunc(s.trustedProxies, func(proxy netip.Prefix) bool {
+		return proxy.Contains(addr)
+	})
+}
+
+// IP address of the client that sent the request
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// IP address of the connection's peer
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Settings of the backend. Each is taken from, in increasing order of
+// precedence: the defaults below, the JSON config file named by -config or
+// CONFIG_FILE, the environment (and a .env file, if there is one), and
+// command-line flags.
+type Config struct {
+	ListenAddress string `json:"listenAddress"`
+	// Key for signing access and refresh tokens; only needed to serve
+	JWTSecret  string `json:"jwtSecret"`
+	AppBaseURL string `json:"appBaseUrl"` // frontend URL used to build links in emails
+	// Origins allowed to call the API from a browser; "*" allows any
+	CORSOrigins []string `json:"corsOrigins"`
+	// Reverse proxies, as addresses or CIDR ranges, whose X-Forwarded-For
+	// header is believed when working out a client's address
+	TrustedProxies []string `json:"trustedProxies"`
+
+	Storage StorageConfig `json:"storage"`
+	Mail    MailConfig    `json:"mail"`
+	Lobbies LobbyConfig   `json:"lobbies"`
+	Game    GameConfig    `json:"game"`
+
+	// Users younger than this need a parent's approval for community features
+	ParentalConsentAge int `json:"parentalConsentAge"`
+	// Time allowed for requests and games to wrap up on SIGINT or SIGTERM
+	ShutdownTimeout configDuration `json:"shutdownTimeout"`
+	// Bearer token Prometheus must send to read /metrics; without one,
+	// /metrics is not served
+	MetricsToken string `json:"metricsToken"`
+
+	Log LogConfig `json:"log"`
+}
+
+type LogConfig struct {
+	Level  string `json:"level"`  // debug, info, warn or error
+	Format string `json:"format"` // text, or json for log collectors
+}
+
+type StorageConfig struct {
+	Backend       string `json:"backend"`  // mongo, sqlite, postgres or memory
+	MongoURI      string `json:"mongoUri"` // may hold a password
+	MongoDatabase string `json:"mongoDatabase"`
+	// SQLite file or PostgreSQL connection string
+	DatabaseURL string `json:"databaseUrl"` // may hold a password
+}
+
+type MailConfig struct {
+	// Emails are written here when set, otherwise kept in memory and logged
+	OutboxDir string `json:"outboxDir"`
+}
+
+// Waiting lobbies are deleted WaitingTTL after they were created, ended
+// ones archived ArchiveAfter after the game ended, and active ones ended
+// StaleAfter after their game last progressed
+type LobbyConfig struct {
+	WaitingTTL      configDuration `json:"waitingTtl"`
+	ArchiveAfter    configDuration `json:"archiveAfter"`
+	StaleAfter      configDuration `json:"staleAfter"`
+	CleanupInterval configDuration `json:"cleanupInterval"`
+}
+
+type GameConfig struct {
+	AnswerTimeout       configDuration `json:"answerTimeout"`
+	CorrectAnswerPoints int            `json:"correctAnswerPoints"`
+	WrongAnswerPenalty  int            `json:"wrongAnswerPenalty"` // subtracted for a wrong answer
+}
+
+// A duration written as in Go, e.g. "30s" or "1h30m", in the config file
+type configDuration time.Duration
+
+func (d configDuration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(duration)
+	return nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		ListenAddress: ":8080",
+		AppBaseURL:    "http://localhost:3000",
+		CORSOrigins:   []string{"*"},
+		Storage: StorageConfig{
+			Backend:       "mongo",
+			MongoDatabase: "game",
+		},
+		Lobbies: LobbyConfig{
+			WaitingTTL:      configDuration(defaultLobbyWaitingTTL),
+			ArchiveAfter:    configDuration(defaultLobbyArchiveAfter),
+			StaleAfter:      configDuration(defaultLobbyStaleAfter),
+			CleanupInterval: configDuration(defaultLobbyCleanupInterval),
+		},
+		Game: GameConfig{
+			AnswerTimeout:       configDuration(30 * time.Second),
+			CorrectAnswerPoints: 10,
+			WrongAnswerPenalty:  10,
+		},
+		ParentalConsentAge: defaultParentalConsentAge,
+		ShutdownTimeout:    configDuration(defaultShutdownTimeout),
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// A setting read from an environment variable and, unless it is a secret
+// that should not show up in the process list, a command-line flag
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func settings() []setting {
+	return []setting{
+		// Hosting platforms pass the port to listen on in PORT
+		{env: "PORT", set: func(c *Config, v string) error {
+			c.ListenAddress = ":" + v
+			return nil
+		}},
+		{env: "LISTEN_ADDRESS", flag: "listen", usage: "address to serve on, e.g. :8080", set: func(c *Config, v string) error {
+			c.ListenAddress = v
+			return nil
+		}},
+		{env: "JWT_SECRET", set: func(c *Config, v string) error {
+			c.JWTSecret = v
+			return nil
+		}},
+		{env: "APP_BASE_URL", flag: "app-base-url", usage: "frontend URL used in email links", set: func(c *Config, v string) error {
+			c.AppBaseURL = v
+			return nil
+		}},
+		{env: "CORS_ORIGINS", flag: "cors-origins", usage: "comma-separated origins allowed by CORS, or *", set: func(c *Config, v string) error {
+			c.CORSOrigins = splitList(v)
+			return nil
+		}},
+		{env: "TRUSTED_PROXIES", flag: "trusted-proxies", usage: "comma-separated proxy addresses or CIDR ranges whose X-Forwarded-For is believed", set: func(c *Config, v string) error {
+			c.TrustedProxies = splitList(v)
+			return nil
+		}},
+		{env: "STORAGE", flag: "storage", usage: "storage backend: mongo, sqlite, postgres or memory", set: func(c *Config, v string) error {
+			c.Storage.Backend = v
+			return nil
+		}},
+		{env: "MONGO_URI", set: func(c *Config, v string) error {
+			c.Storage.MongoURI = v
+			return nil
+		}},
+		{env: "MONGO_DATABASE", flag: "mongo-database", usage: "MongoDB database name", set: func(c *Config, v string) error {
+			c.Storage.MongoDatabase = v
+			return nil
+		}},
+		{env: "DATABASE_URL", set: func(c *Config, v string) error {
+			c.Storage.DatabaseURL = v
+			return nil
+		}},
+		{env: "MAIL_OUTBOX_DIR", flag: "mail-outbox-dir", usage: "directory to write emails to instead of logging them", set: func(c *Config, v string) error {
+			c.Mail.OutboxDir = v
+			return nil
+		}},
+		{env: "PARENTAL_CONSENT_AGE", flag: "parental-consent-age", usage: "age below which parental consent is required", set: func(c *Config, v string) error {
+			return parseInt(&c.ParentalConsentAge, v)
+		}},
+		{env: "LOBBY_WAITING_TTL", flag: "lobby-waiting-ttl", usage: "delete lobbies nobody joined after this long", set: func(c *Config, v string) error {
+			return parseDuration(&c.Lobbies.WaitingTTL, v)
+		}},
+		{env: "LOBBY_ARCHIVE_AFTER", flag: "lobby-archive-after", usage: "archive ended lobbies after this long", set: func(c *Config, v string) error {
+			return parseDuration(&c.Lobbies.ArchiveAfter, v)
+		}},
+		{env: "LOBBY_STALE_AFTER", flag: "lobby-stale-after", usage: "end active games that have not progressed for this long", set: func(c *Config, v string) error {
+			return parseDuration(&c.Lobbies.StaleAfter, v)
+		}},
+		{env: "LOBBY_CLEANUP_INTERVAL", flag: "lobby-cleanup-interval", usage: "how often to clean up lobbies", set: func(c *Config, v string) error {
+			return parseDuration(&c.Lobbies.CleanupInterval, v)
+		}},
+		{env: "GAME_ANSWER_TIMEOUT", flag: "answer-timeout", usage: "time a player has to answer a question", set: func(c *Config, v string) error {
+			return parseDuration(&c.Game.AnswerTimeout, v)
+		}},
+		{env: "GAME_CORRECT_ANSWER_POINTS", flag: "correct-answer-points", usage: "points for a correct answer", set: func(c *Config, v string) error {
+			return parseInt(&c.Game.CorrectAnswerPoints, v)
+		}},
+		{env: "GAME_WRONG_ANSWER_PENALTY", flag: "wrong-answer-penalty", usage: "points taken for a wrong answer", set: func(c *Config, v string) error {
+			return parseInt(&c.Game.WrongAnswerPenalty, v)
+		}},
+		{env: "SHUTDOWN_TIMEOUT", flag: "shutdown-timeout", usage: "time allowed for a graceful shutdown", set: func(c *Config, v string) error {
+			return parseDuration(&c.ShutdownTimeout, v)
+		}},
+		{env: "LOG_LEVEL", flag: "log-level", usage: "least severe level logged: debug, info, warn or error", set: func(c *Config, v string) error {
+			c.Log.Level = v
+			return nil
+		}},
+		{env: "LOG_FORMAT", flag: "log-format", usage: "log line format: text or json", set: func(c *Config, v string) error {
+			c.Log.Format = v
+			return nil
+		}},
+		{env: "METRICS_TOKEN", set: func(c *Config, v string) error {
+			c.MetricsToken = v
+			return nil
+		}},
+	}
+}
+
+func parseInt(target *int, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a whole number", value)
+	}
+	*target = n
+	return nil
+}
+
+func parseDuration(target *configDuration, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration such as 30s or 2h", value)
+	}
+	*target = configDuration(d)
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Build the configuration from every layer. args are the command-line
+// arguments without the program name; whatever follows the flags, such as a
+// subcommand, is returned as rest.
+func loadConfig(args []string) (config Config, rest []string, err error) {
+	// Flags are parsed first to find -config, but applied last
+	flags := flag.NewFlagSet("backend", flag.ContinueOnError)
+	configFile := flags.String("config", "", "JSON config file (default $CONFIG_FILE)")
+	var flagValues []func(c *Config) error
+	for _, s := range settings() {
+		if s.flag == "" {
+			continue
+		}
+		flags.Func(s.flag, s.usage+" ($"+s.env+")", func(value string) error {
+			flagValues = append(flagValues, func(c *Config) error { return s.set(c, value) })
+			return nil
+		})
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	// A .env file is a convenience for development; deployments set the
+	// environment directly
+	if err := godotenv.Load(".env"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Config{}, nil, fmt.Errorf(".env: %w", err)
+	}
+
+	config = defaultConfig()
+
+	if *configFile == "" {
+		*configFile = os.Getenv("CONFIG_FILE")
+	}
+	if *configFile != "" {
+		if err := config.readFile(*configFile); err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	for _, s := range settings() {
+		if value := os.Getenv(s.env); value != "" {
+			if err := s.set(&config, value); err != nil {
+				return Config{}, nil, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+
+	for _, apply := range flagValues {
+		if err := apply(&config); err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	return config, flags.Args(), nil
+}
+
+// Overlay the settings present in a JSON config file
+func (c *Config) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Check every setting, reporting all problems at once. The JWT secret and
+// metrics token are only required when serving, not for subcommands like
+// backup.
+// HS256 keys shorter than the hash output weaken the token signatures
+const minJWTSecretLength = 32
+
+func (c Config) validate(serving bool) error {
+	var problems []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+
+	if serving {
+		_, port, err := net.SplitHostPort(c.ListenAddress)
+		check(err == nil && port != "", "listen address %q must be host:port or :port", c.ListenAddress)
+		check(c.JWTSecret != "", "JWT_SECRET is not set")
+		check(c.JWTSecret == "" || len(c.JWTSecret) >= minJWTSecretLength, "JWT_SECRET must be at least %d bytes", minJWTSecretLength)
+	}
+
+	appURL, err := url.Parse(c.AppBaseURL)
+	check(err == nil && (appURL.Scheme == "http" || appURL.Scheme == "https") && appURL.Host != "",
+		"app base URL %q must be an http or https URL", c.AppBaseURL)
+
+	check(len(c.CORSOrigins) > 0, "at least one CORS origin is required, or * for any")
+	for _, origin := range c.CORSOrigins {
+		check(origin == "*" || isOrigin(origin), "CORS origin %q must be * or scheme://host[:port] without a path", origin)
+	}
+	for _, proxy := range c.TrustedProxies {
+		_, err := parseTrustedProxy(proxy)
+		check(err == nil, "trusted proxy %q must be an IP address or CIDR range", proxy)
+	}
+
+	switch c.Storage.Backend {
+	case "memory":
+	case "sqlite", "postgres":
+		check(c.Storage.DatabaseURL != "", "DATABASE_URL is not set")
+	case "mongo":
+		check(c.Storage.MongoURI != "", "MONGO_URI is not set")
+		check(c.Storage.MongoDatabase != "", "MongoDB database name is empty")
+	default:
+		check(false, "unknown storage %q, expected mongo, sqlite, postgres or memory", c.Storage.Backend)
+	}
+
+	check(c.ParentalConsentAge >= 0, "parental consent age must not be negative")
+	check(c.Lobbies.WaitingTTL > 0, "lobby waiting TTL must be positive")
+	check(c.Lobbies.ArchiveAfter > 0, "lobby archive delay must be positive")
+	// A game still being played saves its progress at least once per question
+	check(c.Lobbies.StaleAfter > c.Game.AnswerTimeout, "lobby stale delay must be longer than the answer timeout")
+	check(c.Lobbies.CleanupInterval > 0, "lobby cleanup interval must be positive")
+	check(c.Game.AnswerTimeout > 0, "answer timeout must be positive")
+	check(c.Game.CorrectAnswerPoints >= 0, "points for a correct answer must not be negative")
+	check(c.Game.WrongAnswerPenalty >= 0, "penalty for a wrong answer must not be negative")
+	check(c.ShutdownTimeout > 0, "shutdown timeout must be positive")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "unknown log level %q, expected debug, info, warn or error", c.Log.Level)
+	check(c.Log.Format == "text" || c.Log.Format == "json", "unknown log format %q, expected text or json", c.Log.Format)
+
+	return errors.Join(problems...)
+}
+
+func isOrigin(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		u.Path == "" && u.RawQuery == "" && u.User == nil
+}
+
+// Key=value connection strings, as PostgreSQL accepts, may carry a password
+var dsnPassword = regexp.MustCompile(`(?i)(password\s*=\s*)('[^']*'|\S+)`)
+
+// The configuration with secrets blanked out, for the log. Database URLs keep
+// everything but their password, which helps tell which database a server is
+// using.
+func (c Config) redacted() Config {
+	if c.JWTSecret != "" {
+		c.JWTSecret = "xxxxx"
+	}
+	if c.MetricsToken != "" {
+		c.MetricsToken = "xxxxx"
+	}
+	c.Storage.MongoURI = redactURL(c.Storage.MongoURI)
+	c.Storage.DatabaseURL = redactURL(c.Storage.DatabaseURL)
+	return c
+}
+
+func redactURL(value string) string {
+	if u, err := url.Parse(value); err == nil && u.Scheme != "" {
+		return u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(value, "${1}xxxxx")
+}
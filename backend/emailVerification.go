@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Email a verification link to the user's current address
+func (s *Server) sendVerificationEmail(ctx context.Context, user User) error {
+	token, err := s.issueOneTimeToken(ctx, emailVerificationPurpose, user.Username, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", s.appBaseURL, url.QueryEscape(token))
+	return s.mailer.Send(Email{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nWelcome! Please confirm your email address by opening the link below. It expires in %v.\n\n%s",
+			user.FirstName, emailVerificationTTL, link),
+	})
+}
+
+// Confirm an email address using the token from the verification email
+func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	token, err := s.consumeOneTimeToken(r.Context(), emailVerificationPurpose, requestData.Token)
+	if err == errInvalidToken {
+		writeValidationError(w, FieldError{Field: "token", Message: "Invalid or expired verification token"})
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to verify token")
+		return
+	}
+
+	_, err = s.updateUser(r.Context(), token.Username, func(user *User) error {
+		verified := true
+		user.EmailVerified = &verified
+		return nil
+	})
+	if err == ErrNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeSaveError(w, err, "Failed to verify email")
+		return
+	}
+
+	s.recordAudit(r, token.Username, auditEmailVerified, token.Username, nil)
+
+	writeMessage(w, http.StatusOK, "Email verified successfully")
+}
+
+// Send a new verification email to the authenticated user
+func (s *Server) handleResendVerification(w http.ResponseWriter, r *http.Request) {
+	user, err := s.users.GetUser(r.Context(), authenticatedUsername(r))
+	if err != nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	if !user.isEmailUnverified() {
+		writeError(w, http.StatusConflict, codeConflict, "Email is already verified")
+		return
+	}
+
+	if err := s.sendVerificationEmail(r.Context(), user); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to send verification email")
+		return
+	}
+
+	writeMessage(w, http.StatusAccepted, "Verification email sent")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Version reported by /status. Release builds set it with
+//
+//	go build -ldflags "-X main.buildVersion=v1.2.3"
+//
+// otherwise the VCS revision recorded by the Go toolchain is used.
+var buildVersion = ""
+
+// When the process started, for the uptime in /status
+var startedAt = time.Now()
+
+// How long the readiness probe waits for the database
+const readinessTimeout = 2 * time.Second
+
+// Liveness probe: the process is up and serving HTTP. It checks nothing
+// else, so a slow database never gets the server restarted.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readiness probe: the server should get traffic. Fails while shutting down,
+// when the database does not answer and when its schema is behind this
+// build. The cause is logged rather than returned, since the probe is public.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"shutdown": "ok", "store": "ok"}
+	ready := true
+
+	if s.draining.Load() {
+		checks["shutdown"] = "draining"
+		ready = false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	if err := s.store.Ping(ctx); err != nil {
+		slog.WarnContext(r.Context(), "Readiness check failed", "error", err)
+		checks["store"] = "unavailable"
+		ready = false
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
+
+// Details about the running server for admins
+type serverStatus struct {
+	Version              string         `json:"version"`
+	GoVersion            string         `json:"goVersion"`
+	StartedAt            time.Time      `json:"startedAt"`
+	UptimeSeconds        int64          `json:"uptimeSeconds"`
+	Draining             bool           `json:"draining"`
+	WebSocketConnections int            `json:"webSocketConnections"`
+	Lobbies              map[string]int `json:"lobbies"` // by status
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := serverStatus{
+		Version:              currentBuildVersion(),
+		GoVersion:            runtime.Version(),
+		StartedAt:            startedAt.UTC(),
+		UptimeSeconds:        int64(time.Since(startedAt).Seconds()),
+		Draining:             s.draining.Load(),
+		WebSocketConnections: s.openWebSocketCount(),
+		Lobbies:              make(map[string]int),
+	}
+
+	counts, err := s.lobbies.CountLobbiesByStatus(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to count lobbies")
+		return
+	}
+	// Archived lobbies only grow, so they are not reported
+	for _, lobbyStatus := range []string{"waiting", "active", "ended"} {
+		status.Lobbies[lobbyStatus] = counts[lobbyStatus]
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// Players connected to the games this process is running
+func (s *Server) openWebSocketCount() int {
+	s.gamesMu.Lock()
+	defer s.gamesMu.Unlock()
+
+	count := 0
+	for _, game := range s.games {
+		game.mu.Lock()
+		count += len(game.players)
+		game.mu.Unlock()
+	}
+	return count
+}
+
+func currentBuildVersion() string {
+	if buildVersion != "" {
+		return buildVersion
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	revision, modified := "unknown", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if modified {
+		return revision + "-dirty"
+	}
+	return revision
+}
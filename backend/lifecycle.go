@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Default time allowed for a shutdown, overridable with SHUTDOWN_TIMEOUT
+const defaultShutdownTimeout = 15 * time.Second
+
+// Serve HTTP until ctx is cancelled, then shut down within shutdownTimeout:
+// stop starting games, save the games in progress for the players to resume,
+// let requests in flight finish and tell WebSocket players the server is
+// going away. The store is left open for the caller to close once its other
+// users have stopped.
+func (s *Server) Run(ctx context.Context) error {
+	httpServer := &http.Server{Addr: s.serverAddress, Handler: s.Handler()}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
+	slog.Info("Server running", "address", s.serverAddress)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down", "timeout", s.shutdownTimeout.String())
+	s.draining.Store(true)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	// Before the connections close, so no game moves on without its players.
+	// Hijacked WebSocket connections are not tracked by Shutdown, so they are
+	// closed here rather than from a RegisterOnShutdown hook the process
+	// might exit before.
+	s.suspendGames(shutdownCtx)
+	s.closeWebSockets()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Gave up waiting for requests to finish", "error", err)
+		httpServer.Close()
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP server stopped with an error", "error", err)
+	}
+	return nil
+}
+
+// Middleware that turns away requests starting a game once a shutdown has
+// begun, since the game could not be finished
+func (s *Server) refuseWhileDraining(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.draining.Load() {
+			writeError(w, http.StatusServiceUnavailable, codeShuttingDown, "The server is restarting, please try again in a moment")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Close every game WebSocket with a going-away message, so players can tell
+// a restart from a network failure
+func (s *Server) closeWebSockets() {
+	s.gamesMu.Lock()
+	defer s.gamesMu.Unlock()
+
+	for _, game := range s.games {
+		game.mu.Lock()
+		game.closeAll(websocket.CloseGoingAway, "Server is restarting")
+		game.mu.Unlock()
+	}
+}
+
+// Stop the games this process is running and save how far each got, leaving
+// the lobbies active so the players can resume them once they reconnect.
+// Games run by other instances are left alone, and nothing is credited.
+func (s *Server) suspendGames(ctx context.Context) {
+	s.stopGames()
+
+	// Let every runner stop, so the progress saved is final
+	stopped := make(chan struct{})
+	go func() {
+		s.gamesDone.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		slog.WarnContext(ctx, "Shutdown timed out waiting for games to stop")
+	}
+
+	s.gamesMu.Lock()
+	games := slices.Collect(maps.Values(s.games))
+	s.gamesMu.Unlock()
+
+	saved := 0
+	for _, game := range games {
+		game.mu.Lock()
+		progress, running := game.lobby, game.running
+		game.mu.Unlock()
+		if !running {
+			continue
+		}
+
+		if err := s.saveGameProgress(ctx, progress); err != nil {
+			slog.ErrorContext(ctx, "Failed to save game progress", "lobby_id", progress.ID, "error", err)
+			continue
+		}
+		saved++
+	}
+	if saved > 0 {
+		slog.InfoContext(ctx, "Saved games in progress for players to resume", "count", saved)
+	}
+}
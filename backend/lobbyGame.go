@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Time allowed for a write to a player's connection before it is dropped
+const gameWriteTimeout = 5 * time.Second
+
+// Time allowed for saving a game's progress or result, which goes ahead even
+// once a shutdown has stopped the game
+const gameSaveTimeout = 10 * time.Second
+
+// A multiplayer game run by this process over its players' WebSockets
+type liveGame struct {
+	mu sync.Mutex // guards the fields below and writes to the connections
+	// Progress as of the last question finished, saved to the store after
+	// every question and when the server shuts down
+	lobby    Lobby
+	players  map[string]*websocket.Conn // connected players by username
+	question *gameMessage               // being asked, for players who reconnect
+	running  bool
+	// The first answer each player gave to the question being asked, and a
+	// signal that one was recorded
+	answers  map[string]string
+	answered chan struct{}
+}
+
+// Sent to the players: each question without its answer, then the final
+// scores when the game has ended
+type gameMessage struct {
+	Type     string         `json:"type"` // "question" or "ended"
+	Index    int            `json:"index"`
+	Question *Question      `json:"question,omitempty"`
+	Scores   map[string]int `json:"scores"`
+}
+
+// Browsers cannot set headers on a WebSocket handshake, so the access token
+// may come as the access_token query parameter instead
+func webSocketAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next(w, r)
+	}
+}
+
+// Play the game of an active lobby over a WebSocket. The game starts, or
+// resumes from the last question saved, once every participant is connected.
+// Players receive the questions without their answers and reply with
+//
+//	{"index": <question index>, "answer": "..."}
+//
+// Games run in the process their players are connected to, so with more than
+// one instance this route must be balanced by lobby ID.
+func (s *Server) handlePlayLobby(w http.ResponseWriter, r *http.Request) {
+	username := authenticatedUsername(r)
+	lobby, err := s.lobbies.GetLobby(r.Context(), r.PathValue("id"))
+	if err == ErrNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, "Lobby not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to find lobby")
+		return
+	}
+	if !slices.Contains(lobby.Participants, username) {
+		writeError(w, http.StatusForbidden, codeForbidden, "You have not joined this lobby")
+		return
+	}
+	if lobby.Status != "active" {
+		writeError(w, http.StatusConflict, codeLobbyUnavailable, "The game has not started or is over")
+		return
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || slices.Contains(s.corsOrigins, "*") || slices.Contains(s.corsOrigins, origin)
+	}}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already answered with an error
+		return
+	}
+
+	game := s.connectPlayer(lobby, username, conn)
+	s.readAnswers(r.Context(), game, username, conn)
+}
+
+// Register a player's connection with the game of their lobby, starting the
+// game when they are the last player it was waiting for
+func (s *Server) connectPlayer(lobby Lobby, username string, conn *websocket.Conn) *liveGame {
+	s.gamesMu.Lock()
+	defer s.gamesMu.Unlock()
+
+	game := s.games[lobby.ID]
+	if game == nil {
+		game = &liveGame{
+			lobby:    lobby,
+			players:  make(map[string]*websocket.Conn),
+			answers:  make(map[string]string),
+			answered: make(chan struct{}, 1),
+		}
+		s.games[lobby.ID] = game
+	}
+
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	// A new connection replaces the player's old one
+	if old := game.players[username]; old != nil {
+		old.Close()
+	}
+	game.players[username] = conn
+	if game.question != nil {
+		game.send(conn, *game.question)
+	}
+
+	if !game.running && len(game.players) == len(game.lobby.Participants) {
+		game.running = true
+		s.gamesDone.Add(1)
+		go s.playGame(game)
+	}
+	return game
+}
+
+// Pass a player's answers to their game until the connection is closed
+func (s *Server) readAnswers(ctx context.Context, game *liveGame, username string, conn *websocket.Conn) {
+	defer s.disconnectPlayer(game, username, conn)
+	for {
+		var answer Answer
+		if err := conn.ReadJSON(&answer); err != nil {
+			slog.DebugContext(ctx, "Player disconnected", "lobby_id", game.lobby.ID, "error", err)
+			return
+		}
+		game.recordAnswer(username, answer)
+	}
+}
+
+// Keep a player's first answer to the question being asked. Repeats and late
+// answers to an earlier question are ignored, so a player sending a stream of
+// answers cannot crowd out the others.
+func (game *liveGame) recordAnswer(username string, answer Answer) {
+	game.mu.Lock()
+	defer game.mu.Unlock()
+
+	if game.question == nil || answer.Index != game.question.Index {
+		return
+	}
+	if _, ok := game.answers[username]; ok {
+		return
+	}
+	game.answers[username] = answer.Answer
+	select {
+	case game.answered <- struct{}{}:
+	default:
+		// The game has yet to see an earlier signal, and will count this
+		// answer with it
+	}
+}
+
+func (s *Server) disconnectPlayer(game *liveGame, username string, conn *websocket.Conn) {
+	conn.Close()
+
+	s.gamesMu.Lock()
+	defer s.gamesMu.Unlock()
+	game.mu.Lock()
+	defer game.mu.Unlock()
+
+	if game.players[username] == conn {
+		delete(game.players, username)
+	}
+	// A game in progress keeps going so its players can come back to it; one
+	// that never started is forgotten once everyone has left
+	if !game.running && len(game.players) == 0 && s.games[game.lobby.ID] == game {
+		delete(s.games, game.lobby.ID)
+	}
+}
+
+// Ask the questions left in a game, saving the progress after each one, then
+// end it. Stops between questions when the server shuts down; a save or the
+// end of the game already under way is finished first, so no progress or
+// score is lost.
+func (s *Server) playGame(game *liveGame) {
+	defer s.gamesDone.Done()
+	ctx := s.gamesCtx
+
+	game.mu.Lock()
+	lobbyID, start, count := game.lobby.ID, game.lobby.CurrentIndex, len(game.lobby.Questions)
+	game.mu.Unlock()
+
+	for index := start; index < count; index++ {
+		scores, ok := s.askQuestion(ctx, game, index)
+		if !ok {
+			return
+		}
+
+		game.mu.Lock()
+		game.lobby.CurrentIndex = index + 1
+		game.lobby.Scores = scores
+		progress := game.lobby
+		game.mu.Unlock()
+
+		saveCtx, cancel := s.gameSaveContext()
+		err := s.saveGameProgress(saveCtx, progress)
+		cancel()
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to save game progress", "lobby_id", lobbyID, "error", err)
+		}
+	}
+
+	game.mu.Lock()
+	final := game.lobby
+	game.mu.Unlock()
+
+	saveCtx, cancel := s.gameSaveContext()
+	lobby, err := s.endGame(saveCtx, final)
+	cancel()
+
+	s.gamesMu.Lock()
+	delete(s.games, lobbyID)
+	s.gamesMu.Unlock()
+
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	game.question = nil
+	if err != nil {
+		// The lobby stays active with the progress saved, so the players can
+		// reconnect to try again
+		slog.ErrorContext(ctx, "Failed to end game", "lobby_id", lobbyID, "error", err)
+		game.closeAll(websocket.CloseInternalServerErr, "Failed to end the game")
+		return
+	}
+	game.broadcast(gameMessage{Type: "ended", Index: lobby.CurrentIndex, Scores: lobby.Scores})
+	game.closeAll(websocket.CloseNormalClosure, "Game over")
+}
+
+// Send a question to the players and score the first answer each gives before
+// the answer timeout. Returns the scores after the question, or false if the
+// game was stopped.
+func (s *Server) askQuestion(ctx context.Context, game *liveGame, index int) (map[string]int, bool) {
+	game.mu.Lock()
+	question := game.lobby.Questions[index]
+	players := len(game.lobby.Participants)
+	scores := maps.Clone(game.lobby.Scores)
+	if scores == nil {
+		scores = make(map[string]int)
+	}
+	hidden := question
+	hidden.CorrectAnswer = ""
+	game.answers = make(map[string]string)
+	game.question = &gameMessage{Type: "question", Index: index, Question: &hidden, Scores: maps.Clone(scores)}
+	game.broadcast(*game.question)
+	game.mu.Unlock()
+
+	timeout := time.NewTimer(s.answerTimeout)
+	defer timeout.Stop()
+
+waiting:
+	for {
+		game.mu.Lock()
+		allAnswered := len(game.answers) >= players
+		game.mu.Unlock()
+		if allAnswered {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-timeout.C:
+			slog.InfoContext(ctx, "Timeout waiting for answers", "lobby_id", game.lobby.ID, "question_index", index)
+			break waiting
+		case <-game.answered:
+		}
+	}
+
+	game.mu.Lock()
+	defer game.mu.Unlock()
+	for username, answer := range game.answers {
+		scores[username] += s.scoreAnswer(question, answer)
+	}
+	return scores, true
+}
+
+// Context for saving a game's progress or result. It is not cancelled with
+// gamesCtx, so a save under way when the server shuts down still completes.
+func (s *Server) gameSaveContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(s.gamesCtx), gameSaveTimeout)
+}
+
+// Points gained, or lost, for an answer
+func (s *Server) scoreAnswer(question Question, answer string) int {
+	if answer == question.CorrectAnswer {
+		answersSubmittedTotal.WithLabelValues("correct").Inc()
+		return s.correctAnswerPoints
+	}
+	answersSubmittedTotal.WithLabelValues("wrong").Inc()
+	return -s.wrongAnswerPenalty
+}
+
+// Store the question index and scores a game has reached, so it can resume
+// from there
+func (s *Server) saveGameProgress(ctx context.Context, progress Lobby) error {
+	_, err := s.updateLobby(ctx, progress.ID, func(lobby *Lobby) error {
+		if lobby.Status != "active" {
+			return errLobbyNotActive
+		}
+		now := time.Now()
+		lobby.CurrentIndex = progress.CurrentIndex
+		lobby.Scores = progress.Scores
+		lobby.ProgressAt = &now
+		return nil
+	})
+	return err
+}
+
+// Send a message to every connected player. The caller holds game.mu.
+func (game *liveGame) broadcast(message gameMessage) {
+	for _, conn := range game.players {
+		game.send(conn, message)
+	}
+}
+
+// Send a message to one player, dropping a connection that cannot take it.
+// The caller holds game.mu.
+func (game *liveGame) send(conn *websocket.Conn, message gameMessage) {
+	conn.SetWriteDeadline(time.Now().Add(gameWriteTimeout))
+	if err := conn.WriteJSON(message); err != nil {
+		slog.Warn("Failed to send game message", "lobby_id", game.lobby.ID, "error", err)
+		conn.Close()
+	}
+}
+
+// Close every player's connection with a close message. The caller holds
+// game.mu.
+func (game *liveGame) closeAll(code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	deadline := time.Now().Add(time.Second)
+	for _, conn := range game.players {
+		conn.WriteControl(websocket.CloseMessage, message, deadline)
+		conn.Close()
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A store that behaves like a database honouring cancellation, and shuts the
+// server down just as a game is being ended
+type shutdownDuringEndStore struct {
+	*MemoryStore
+	server *Server
+}
+
+func (s *shutdownDuringEndStore) SaveLobby(ctx context.Context, lobby Lobby) error {
+	if lobby.Status == "ended" {
+		s.server.stopGames()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.MemoryStore.SaveLobby(ctx, lobby)
+}
+
+func (s *shutdownDuringEndStore) AddMultiPlayerScore(ctx context.Context, username string, delta int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.MemoryStore.AddMultiPlayerScore(ctx, username, delta)
+}
+
+func TestShutdownWhileEndingGame(t *testing.T) {
+	ctx := context.Background()
+	store := &shutdownDuringEndStore{MemoryStore: NewMemoryStore()}
+	config := defaultConfig()
+	config.JWTSecret = "test-secret-test-secret-test-secret"
+	server := NewServer(config, store)
+	store.server = server
+
+	for _, username := range []string{"alice", "bob"} {
+		if err := store.CreateUser(ctx, testUser(username)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every question has been asked, so the runner goes straight to ending it
+	lobby := testLobby("lobby-1", "alice")
+	lobby.Participants = []string{"alice", "bob"}
+	lobby.Status = "active"
+	lobby.CurrentIndex = len(lobby.Questions)
+	lobby.Scores = map[string]int{"alice": 10, "bob": -5}
+	if err := store.CreateLobby(ctx, lobby); err != nil {
+		t.Fatal(err)
+	}
+
+	game := &liveGame{
+		lobby:    lobby,
+		players:  make(map[string]*websocket.Conn),
+		answers:  make(map[string]string),
+		answered: make(chan struct{}, 1),
+		running:  true,
+	}
+	server.games[lobby.ID] = game
+	server.gamesDone.Add(1)
+	server.playGame(game)
+
+	if server.gamesCtx.Err() == nil {
+		t.Fatal("the store did not shut the server down")
+	}
+	ended, err := store.GetLobby(ctx, lobby.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ended.Status != "ended" {
+		t.Fatalf("lobby status %q, want ended", ended.Status)
+	}
+	for username, score := range lobby.Scores {
+		user, err := store.GetUser(ctx, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.MultiPlayerScore != score {
+			t.Errorf("%s has score %d, want %d", username, user.MultiPlayerScore, score)
+		}
+	}
+}
+
+func TestRecordAnswerKeepsOneAnswerPerPlayer(t *testing.T) {
+	game := &liveGame{
+		question: &gameMessage{Type: "question", Index: 1},
+		answers:  make(map[string]string),
+		answered: make(chan struct{}, 1),
+	}
+
+	// A stream of answers from one player does not push out the other's
+	for range 10 {
+		game.recordAnswer("alice", Answer{Index: 1, Answer: "3"})
+	}
+	game.recordAnswer("alice", Answer{Index: 1, Answer: "4"})
+	game.recordAnswer("bob", Answer{Index: 0, Answer: "late"})
+	game.recordAnswer("bob", Answer{Index: 1, Answer: "4"})
+
+	want := map[string]string{"alice": "3", "bob": "4"}
+	if len(game.answers) != len(want) {
+		t.Fatalf("answers %v, want %v", game.answers, want)
+	}
+	for username, answer := range want {
+		if game.answers[username] != answer {
+			t.Fatalf("answers %v, want %v", game.answers, want)
+		}
+	}
+
+	select {
+	case <-game.answered:
+	case <-time.After(time.Second):
+		t.Fatal("no signal that answers were recorded")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Defaults for the lobby janitor, overridable with LOBBY_WAITING_TTL,
+// LOBBY_ARCHIVE_AFTER, LOBBY_STALE_AFTER and LOBBY_CLEANUP_INTERVAL
+const (
+	defaultLobbyWaitingTTL      = time.Hour
+	defaultLobbyArchiveAfter    = 24 * time.Hour
+	defaultLobbyStaleAfter      = time.Hour
+	defaultLobbyCleanupInterval = 5 * time.Minute
+)
+
+// Periodically delete lobbies nobody joined, end games nobody is playing any
+// more and archive finished games, so none of them piles up in the lobby list
+func (s *Server) runLobbyJanitor(ctx context.Context) {
+	ticker := time.NewTicker(s.lobbyCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		s.cleanUpLobbies(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) cleanUpLobbies(ctx context.Context) {
+	now := time.Now()
+
+	expired, err := s.lobbies.DeleteWaitingLobbies(ctx, now.Add(-s.lobbyWaitingTTL), lobbyCapacity)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to expire waiting lobbies", "error", err)
+	} else if expired > 0 {
+		lobbiesExpiredTotal.Add(float64(expired))
+		slog.InfoContext(ctx, "Expired lobbies left waiting", "count", expired, "waiting_ttl", s.lobbyWaitingTTL.String())
+	}
+
+	// Games normally save their progress after every question, and on
+	// shutdown for the players to resume them; one that has not for this long
+	// was lost, e.g. in a crash, and nobody came back to it
+	abandoned, err := s.lobbies.EndStaleLobbies(ctx, now.Add(-s.lobbyStaleAfter))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to end abandoned games", "error", err)
+	} else if abandoned > 0 {
+		lobbiesAbandonedTotal.Add(float64(abandoned))
+		slog.InfoContext(ctx, "Ended abandoned games", "count", abandoned, "stale_after", s.lobbyStaleAfter.String())
+	}
+
+	archived, err := s.lobbies.ArchiveEndedLobbies(ctx, now.Add(-s.lobbyArchiveAfter))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to archive ended lobbies", "error", err)
+	} else if archived > 0 {
+		lobbiesArchivedTotal.Add(float64(archived))
+		slog.InfoContext(ctx, "Archived ended lobbies", "count", archived, "archive_after", s.lobbyArchiveAfter.String())
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// Request-scoped values added to every log line written with the request's
+// context, next to the username set by authMiddleware
+const (
+	requestIDContextKey contextKey = "request_id"
+	routeContextKey     contextKey = "route"
+)
+
+// Install the default slog logger described by a validated config. Lines go
+// to standard error, as text for people or as JSON for log collectors; output
+// of the standard log package goes through the same handler.
+func setupLogging(config LogConfig) {
+	var level slog.Level
+	level.UnmarshalText([]byte(config.Level))
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if config.Format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// Log an error and exit, for failures the server cannot start with
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Handler adding the request ID, route and username found in the context
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	for _, key := range []contextKey{requestIDContextKey, routeContextKey, usernameContextKey} {
+		if value, ok := ctx.Value(key).(string); ok && value != "" {
+			record.AddAttrs(slog.String(string(key), value))
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Record the route pattern the mux matched in the request context, for the
+// log lines written while serving it
+func withRoute(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), routeContextKey, r.Pattern)
+		next(w, r.WithContext(ctx))
+	}
+}
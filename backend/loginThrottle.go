@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Failed attempts allowed for one account before it is locked. Every
+	// further failure doubles the lockout, up to maxAccountLockout.
+	maxFailedLoginAttempts = 5
+	baseAccountLockout     = time.Minute
+	maxAccountLockout      = time.Hour
+
+	// Failed attempts allowed from one IP address within ipFailureWindow,
+	// across all usernames. A successful login from the address clears its
+	// count, so users sharing an address, e.g. a school network, do not lock
+	// each other out with the odd typo.
+	maxFailedLoginsPerIP = 20
+	ipFailureWindow      = 15 * time.Minute
+)
+
+// Counts attempts per key, such as a client IP, in memory and blocks a key
+// once it reaches limit attempts within a fixed window
+type attemptLimiter struct {
+	limit    int
+	window   time.Duration
+	mutex    sync.Mutex
+	attempts map[string]*attemptWindow
+}
+
+type attemptWindow struct {
+	count       int
+	windowStart time.Time
+}
+
+func newAttemptLimiter(limit int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{limit: limit, window: window, attempts: make(map[string]*attemptWindow)}
+}
+
+// How long the key has to wait before trying again, zero if it is not blocked
+func (l *attemptLimiter) retryAfter(key string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry, ok := l.attempts[key]
+	if !ok || entry.count < l.limit {
+		return 0
+	}
+	return time.Until(entry.windowStart.Add(l.window))
+}
+
+// Record an attempt for the key and report whether it is now blocked
+func (l *attemptLimiter) record(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	entry, ok := l.attempts[key]
+	if !ok || now.Sub(entry.windowStart) >= l.window {
+		l.pruneExpired(now)
+		entry = &attemptWindow{windowStart: now}
+		l.attempts[key] = entry
+	}
+	entry.count++
+	return entry.count == l.limit
+}
+
+// Forget the attempts for the key, e.g. failed logins from an IP after a
+// successful login from it
+func (l *attemptLimiter) forget(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.attempts, key)
+}
+
+// Drop windows that have ended so the map does not grow without bound
+func (l *attemptLimiter) pruneExpired(now time.Time) {
+	for key, entry := range l.attempts {
+		if now.Sub(entry.windowStart) >= l.window {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+// Lockout duration after the given number of consecutive failures
+func accountLockoutFor(failedAttempts int) time.Duration {
+	if failedAttempts < maxFailedLoginAttempts {
+		return 0
+	}
+	lockout := baseAccountLockout * time.Duration(math.Pow(2, float64(failedAttempts-maxFailedLoginAttempts)))
+	if lockout <= 0 || lockout > maxAccountLockout {
+		return maxAccountLockout
+	}
+	return lockout
+}
+
+// Count a failed password for the user and lock the account once the limit is
+// reached. Returns the lockout applied, zero if the account is still open.
+func (s *Server) recordFailedLogin(r *http.Request, username string) (time.Duration, error) {
+	failedAttempts, err := s.users.IncrementFailedLogins(r.Context(), username)
+	if err != nil {
+		return 0, err
+	}
+
+	lockout := accountLockoutFor(failedAttempts)
+	if lockout == 0 {
+		return 0, nil
+	}
+
+	_, err = s.updateUser(r.Context(), username, func(user *User) error {
+		user.LockedUntil = time.Now().Add(lockout)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.recordAudit(r, "", auditAccountLocked, username, map[string]string{
+		"failedAttempts": strconv.Itoa(failedAttempts),
+		"lockedFor":      lockout.String(),
+	})
+	return lockout, nil
+}
+
+// Audit a failed login and count it against the client IP, auditing the
+// moment the IP gets blocked
+func (s *Server) recordLoginFailure(r *http.Request, username, reason string) {
+	loginsTotal.WithLabelValues("failed").Inc()
+	s.recordAudit(r, "", auditLoginFailed, username, map[string]string{"reason": reason})
+	if s.loginLimiter.record(clientIP(r)) {
+		s.recordAudit(r, "", auditLoginRateLimited, username, nil)
+	}
+}
+
+// Answer a wrong password or code: count it against the client IP and the
+// account, then respond 423 if that locked the account or 401 with message
+func (s *Server) rejectCredentials(w http.ResponseWriter, r *http.Request, username, reason, message string) {
+	s.recordLoginFailure(r, username, reason)
+	lockout, err := s.recordFailedLogin(r, username)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to record failed login", "username", username, "error", err)
+	}
+	if lockout > 0 {
+		writeRetryAfter(w, http.StatusLocked, "Account is temporarily locked after too many failed login attempts", lockout)
+		return
+	}
+	writeError(w, http.StatusUnauthorized, codeUnauthorized, message)
+}
+
+// Clear the failure counter after a successful login
+func (s *Server) resetFailedLogins(ctx context.Context, username string) error {
+	_, err := s.updateUser(ctx, username, func(user *User) error {
+		user.FailedLoginAttempts = 0
+		user.LockedUntil = time.Time{}
+		return nil
+	})
+	return err
+}
+
+// Write a 429 or 423 response with a Retry-After header in whole seconds
+func writeRetryAfter(w http.ResponseWriter, status int, message string, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	code := codeRateLimited
+	if status == http.StatusLocked {
+		code = codeAccountLocked
+	}
+	writeError(w, status, code, message)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// An outgoing email
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails. Implementations can be swapped without touching the
+// handlers: a real SMTP/API mailer in production, an outbox for development.
+type Mailer interface {
+	Send(email Email) error
+}
+
+// Writes every email to a file in a directory, for local development
+type FileMailer struct {
+	dir string
+}
+
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir}, nil
+}
+
+func (m *FileMailer) Send(email Email) error {
+	name := fmt.Sprintf("%d.eml", time.Now().UnixNano())
+	content := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", email.To, email.Subject, email.Body)
+	return os.WriteFile(filepath.Join(m.dir, name), []byte(content), 0o644)
+}
+
+// Keeps every email in memory and logs it, used when no outbox is configured.
+// The body, which holds links with single-use tokens, is only logged at debug
+// level, so a developer can follow the links without an outbox.
+type MemoryMailer struct {
+	mutex sync.Mutex
+	sent  []Email
+}
+
+func (m *MemoryMailer) Send(email Email) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sent = append(m.sent, email)
+	slog.Info("Mail kept in memory", "to", email.To, "subject", email.Subject)
+	slog.Debug("Mail body", "to", email.To, "body", email.Body)
+	return nil
+}
+
+// Emails sent so far, oldest first
+func (m *MemoryMailer) Sent() []Email {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append([]Email(nil), m.sent...)
+}
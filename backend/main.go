@@ -2,34 +2,126 @@ package main
 
 import (
 	"context"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
-	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
-	// Load the .env file
-	err := godotenv.Load(".env")
+	config, args, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		fatal("Failed to load configuration", "error", err)
+	}
+
+	// Subcommands such as backup run against the store and exit instead of
+	// starting the server
+	serving := len(args) == 0
+	if err := config.validate(serving); err != nil {
+		fatal("Invalid configuration", "error", err)
 	}
+	setupLogging(config.Log)
+	slog.Info("Effective configuration", "config", config.redacted())
+
+	store := openStore(config.Storage)
 
-	// Check if environment variables are being loaded correctly
-	mongoURI := os.Getenv("MONGO_URI")
-	if mongoURI == "" {
-		log.Fatal("MONGO_URI is not set")
+	if !serving {
+		err := runCommand(context.Background(), store, args[0], args[1:])
+		store.Close(context.TODO())
+		if err != nil {
+			fatal("Command failed", "command", args[0], "error", err)
+		}
+		return
 	}
+	// Shut down gracefully on Ctrl-C and on the SIGTERM sent by deployments
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Create a new server
-	server := NewServer(":8080")
+	server := NewServer(config, store)
+	server.registerMetrics(prometheus.DefaultRegisterer)
 
-	// Connect to MongoDB
-	if err := server.ConnectMongoDB(); err != nil {
-		log.Fatal(err)
+	// Write emails to an outbox directory when one is configured, otherwise
+	// keep them in memory and log them
+	if config.Mail.OutboxDir != "" {
+		mailer, err := NewFileMailer(config.Mail.OutboxDir)
+		if err != nil {
+			fatal("Failed to open the mail outbox", "error", err)
+		}
+		server.mailer = mailer
 	}
-	defer server.mongoClient.Disconnect(context.TODO())
 
-	// Run the server
-	server.Run()
+	var workers sync.WaitGroup
+	workers.Add(2)
+
+	// Purge accounts whose deletion grace period has ended
+	go func() {
+		defer workers.Done()
+		server.runAccountDeletionWorker(ctx)
+	}()
+
+	// Expire abandoned lobbies and archive finished games
+	go func() {
+		defer workers.Done()
+		server.runLobbyJanitor(ctx)
+	}()
+
+	// Run the server until a signal arrives, then close the store once
+	// nothing uses it any more
+	err = server.Run(ctx)
+	stop()
+	workers.Wait()
+	store.Close(context.TODO())
+	if err != nil {
+		fatal("Server failed", "error", err)
+	}
+	slog.Info("Server stopped")
+}
+
+// Open the configured storage backend: MongoDB, SQLite or PostgreSQL, or
+// memory, which keeps everything in process and needs no database
+func openStore(config StorageConfig) Store {
+	switch config.Backend {
+	case "memory":
+		slog.Warn("Using in-memory storage; data is lost on exit")
+		return NewMemoryStore()
+	case "sqlite", "postgres":
+		sqlStore, err := NewSQLStore(config.Backend, config.DatabaseURL)
+		if err != nil {
+			fatal("Failed to open the database", "storage", config.Backend, "error", err)
+		}
+		return sqlStore
+	default:
+		mongoStore, err := NewMongoStore(config.MongoURI, config.MongoDatabase)
+		if err != nil {
+			fatal("Failed to open the database", "storage", config.Backend, "error", err)
+		}
+		return mongoStore
+	}
+}
+
+// Run a command-line subcommand:
+//
+//	backup -file <path> [-include-credentials]
+//	restore -file <path> [-dry-run]
+//	set-role -user <username> [-role admin]
+func runCommand(ctx context.Context, store Store, name string, args []string) error {
+	switch name {
+	case "backup":
+		return runBackupCommand(ctx, store, args)
+	case "restore":
+		return runRestoreCommand(ctx, store, args)
+	case "set-role":
+		return runSetRoleCommand(ctx, store, args)
+	default:
+		return fmt.Errorf("unknown command %q, expected backup, restore or set-role", name)
+	}
 }
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Thread-safe in-memory Store, for local development and tests. Everything is
+// lost when the process exits. Values are copied on the way in and out so
+// callers can never modify stored data without going through the store.
+type MemoryStore struct {
+	mutex    sync.RWMutex
+	users    map[string]User
+	lobbies  map[string]Lobby
+	tokens   map[string]OneTimeToken // keyed by token hash
+	audit    []AuditEvent
+	consents []ConsentRecord
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:   make(map[string]User),
+		lobbies: make(map[string]Lobby),
+		tokens:  make(map[string]OneTimeToken),
+	}
+}
+
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *MemoryStore) Close(ctx context.Context) error {
+	return nil
+}
+
+// Users
+
+func (m *MemoryStore) GetUser(ctx context.Context, username string) (User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+	return cloneUser(user), nil
+}
+
+func (m *MemoryStore) FindUserByEmail(ctx context.Context, email string) (User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, user := range m.users {
+		if user.Email == email {
+			return cloneUser(user), nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (m *MemoryStore) ListUsers(ctx context.Context) ([]User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	users := make([]User, 0, len(m.users))
+	for _, user := range m.users {
+		users = append(users, cloneUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (m *MemoryStore) TopUsersByScore(ctx context.Context, limit int) ([]User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	users := []User{}
+	for _, user := range m.users {
+		if user.restrictionReason() == "" {
+			users = append(users, cloneUser(user))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].MultiPlayerScore != users[j].MultiPlayerScore {
+			return users[i].MultiPlayerScore > users[j].MultiPlayerScore
+		}
+		return users[i].Username < users[j].Username
+	})
+	return users[:min(limit, len(users))], nil
+}
+
+func (m *MemoryStore) UsersPendingDeletion(ctx context.Context, before time.Time) ([]User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	users := []User{}
+	for _, user := range m.users {
+		if user.DeletionScheduledFor != nil && !user.DeletionScheduledFor.After(before) {
+			users = append(users, cloneUser(user))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].DeletionScheduledFor.Equal(*users[j].DeletionScheduledFor) {
+			return users[i].DeletionScheduledFor.Before(*users[j].DeletionScheduledFor)
+		}
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+func (m *MemoryStore) CreateUser(ctx context.Context, user User) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.users[user.Username]; ok {
+		return ErrUserExists
+	}
+	m.users[user.Username] = cloneUser(user)
+	return nil
+}
+
+func (m *MemoryStore) SaveUser(ctx context.Context, user User) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, ok := m.users[user.Username]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != user.Version {
+		return ErrConflict
+	}
+	user.Version++
+	m.users[user.Username] = cloneUser(user)
+	return nil
+}
+
+func (m *MemoryStore) DeleteUser(ctx context.Context, username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.users, username)
+	return nil
+}
+
+func (m *MemoryStore) IncrementFailedLogins(ctx context.Context, username string) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	user.FailedLoginAttempts++
+	user.Version++
+	m.users[username] = user
+	return user.FailedLoginAttempts, nil
+}
+
+func (m *MemoryStore) AddMultiPlayerScore(ctx context.Context, username string, delta int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return ErrNotFound
+	}
+	user.MultiPlayerScore += delta
+	user.Version++
+	m.users[username] = user
+	return nil
+}
+
+func (m *MemoryStore) UseTOTPStep(ctx context.Context, username string, step int64) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return false, ErrNotFound
+	}
+	if user.TwoFactor.LastUsedStep >= step {
+		return false, nil
+	}
+	user.TwoFactor.LastUsedStep = step
+	user.Version++
+	m.users[username] = user
+	return true, nil
+}
+
+func (m *MemoryStore) UseRecoveryCode(ctx context.Context, username, codeHash string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user, ok := m.users[username]
+	if !ok {
+		return false, ErrNotFound
+	}
+	index := slices.Index(user.TwoFactor.RecoveryCodes, codeHash)
+	if index < 0 {
+		return false, nil
+	}
+	user.TwoFactor.RecoveryCodes = slices.Delete(slices.Clone(user.TwoFactor.RecoveryCodes), index, index+1)
+	user.Version++
+	m.users[username] = user
+	return true, nil
+}
+
+// Lobbies
+
+func (m *MemoryStore) CreateLobby(ctx context.Context, lobby Lobby) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.lobbies[lobby.ID] = cloneLobby(lobby)
+	return nil
+}
+
+func (m *MemoryStore) GetLobby(ctx context.Context, id string) (Lobby, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	lobby, ok := m.lobbies[id]
+	if !ok {
+		return Lobby{}, ErrNotFound
+	}
+	return cloneLobby(lobby), nil
+}
+
+func (m *MemoryStore) ListLobbies(ctx context.Context) ([]Lobby, error) {
+	return m.filterLobbies(func(Lobby) bool { return true }), nil
+}
+
+func (m *MemoryStore) ListLobbiesByParticipant(ctx context.Context, username string) ([]Lobby, error) {
+	return m.filterLobbies(func(lobby Lobby) bool {
+		return slices.Contains(lobby.Participants, username)
+	}), nil
+}
+
+func (m *MemoryStore) SaveLobby(ctx context.Context, lobby Lobby) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, ok := m.lobbies[lobby.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	if stored.Version != lobby.Version {
+		return ErrConflict
+	}
+	lobby.Version++
+	m.lobbies[lobby.ID] = cloneLobby(lobby)
+	return nil
+}
+
+func (m *MemoryStore) JoinLobby(ctx context.Context, id, username string, capacity int) (Lobby, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	lobby, ok := m.lobbies[id]
+	if !ok {
+		return Lobby{}, ErrNotFound
+	}
+	if lobby.Status != "waiting" || len(lobby.Participants) >= capacity || slices.Contains(lobby.Participants, username) {
+		return Lobby{}, joinRefusal(lobby, username)
+	}
+
+	lobby = cloneLobby(lobby)
+	lobby.Participants = append(lobby.Participants, username)
+	if len(lobby.Participants) >= capacity {
+		now := time.Now()
+		lobby.Status = "active"
+		lobby.ProgressAt = &now
+	}
+	lobby.Version++
+	m.lobbies[id] = lobby
+	return cloneLobby(lobby), nil
+}
+
+func (m *MemoryStore) ListLobbiesByStatus(ctx context.Context, status string) ([]Lobby, error) {
+	return m.filterLobbies(func(lobby Lobby) bool { return lobby.Status == status }), nil
+}
+
+func (m *MemoryStore) CountLobbiesByStatus(ctx context.Context) (map[string]int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	counts := make(map[string]int)
+	for _, lobby := range m.lobbies {
+		counts[lobby.Status]++
+	}
+	return counts, nil
+}
+
+func (m *MemoryStore) DeleteWaitingLobbies(ctx context.Context, createdBefore time.Time, capacity int) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	deleted := 0
+	for id, lobby := range m.lobbies {
+		if lobby.Status == "waiting" && len(lobby.Participants) < capacity && lobby.CreatedAt.Before(createdBefore) {
+			delete(m.lobbies, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MemoryStore) ArchiveEndedLobbies(ctx context.Context, endedBefore time.Time) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	archived := 0
+	for id, lobby := range m.lobbies {
+		if lobby.Status == "ended" && lobby.EndedAt != nil && lobby.EndedAt.Before(endedBefore) {
+			lobby.Status = "archived"
+			lobby.Version++
+			m.lobbies[id] = lobby
+			archived++
+		}
+	}
+	return archived, nil
+}
+
+func (m *MemoryStore) EndStaleLobbies(ctx context.Context, progressBefore time.Time) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	ended := 0
+	for id, lobby := range m.lobbies {
+		if lobby.Status == "active" && lobby.ProgressAt != nil && lobby.ProgressAt.Before(progressBefore) {
+			lobby.Status = "ended"
+			lobby.EndedAt = &now
+			lobby.Version++
+			m.lobbies[id] = lobby
+			ended++
+		}
+	}
+	return ended, nil
+}
+
+// Matching lobbies, oldest first
+func (m *MemoryStore) filterLobbies(match func(Lobby) bool) []Lobby {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	lobbies := []Lobby{}
+	for _, lobby := range m.lobbies {
+		if match(lobby) {
+			lobbies = append(lobbies, cloneLobby(lobby))
+		}
+	}
+	sort.Slice(lobbies, func(i, j int) bool { return lobbies[i].CreatedAt.Before(lobbies[j].CreatedAt) })
+	return lobbies
+}
+
+// Tokens
+
+func (m *MemoryStore) CreateToken(ctx context.Context, token OneTimeToken) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for hash, existing := range m.tokens {
+		if existing.Purpose == token.Purpose && existing.Username == token.Username && existing.UsedAt == nil {
+			usedAt := token.CreatedAt
+			existing.UsedAt = &usedAt
+			m.tokens[hash] = existing
+		}
+	}
+	m.tokens[token.TokenHash] = token
+	return nil
+}
+
+func (m *MemoryStore) ConsumeToken(ctx context.Context, purpose, tokenHash string, now time.Time) (OneTimeToken, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	token, ok := m.tokens[tokenHash]
+	if !ok || token.Purpose != purpose || token.UsedAt != nil || !now.Before(token.ExpiresAt) {
+		return OneTimeToken{}, ErrNotFound
+	}
+	token.UsedAt = &now
+	m.tokens[tokenHash] = token
+	return token, nil
+}
+
+func (m *MemoryStore) DeleteUserTokens(ctx context.Context, username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	maps.DeleteFunc(m.tokens, func(_ string, token OneTimeToken) bool {
+		return token.Username == username
+	})
+	return nil
+}
+
+// Audit log
+
+func (m *MemoryStore) AppendAuditEvent(ctx context.Context, event AuditEvent) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	event.Details = maps.Clone(event.Details)
+	m.audit = append(m.audit, event)
+	return nil
+}
+
+func (m *MemoryStore) QueryAuditEvents(ctx context.Context, query AuditQuery) ([]AuditEvent, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	events := []AuditEvent{}
+	for i := len(m.audit) - 1; i >= 0; i-- {
+		if query.Limit > 0 && len(events) >= query.Limit {
+			break
+		}
+		event := m.audit[i]
+		if !query.matches(event) {
+			continue
+		}
+		event.Details = maps.Clone(event.Details)
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (m *MemoryStore) PseudonymizeAuditEvents(ctx context.Context, username, placeholder string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i := range m.audit {
+		if m.audit[i].Actor == username {
+			m.audit[i].Actor = placeholder
+		}
+		if m.audit[i].Target == username {
+			m.audit[i].Target = placeholder
+		}
+	}
+	return nil
+}
+
+// Whether an event passes the query's filters (the limit is not considered)
+func (q AuditQuery) matches(event AuditEvent) bool {
+	if q.User != "" && event.Actor != q.User && event.Target != q.User {
+		return false
+	}
+	if q.Action != "" && event.Action != q.Action {
+		return false
+	}
+	if !q.From.IsZero() && event.Timestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && event.Timestamp.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// Parental consent records
+
+func (m *MemoryStore) AddConsentRecord(ctx context.Context, record ConsentRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.consents = append(m.consents, record)
+	return nil
+}
+
+func (m *MemoryStore) ListConsentRecords(ctx context.Context, username string) ([]ConsentRecord, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	records := []ConsentRecord{}
+	for _, record := range m.consents {
+		if username == "" || record.Username == username {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (m *MemoryStore) PseudonymizeConsentRecords(ctx context.Context, username, placeholder string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i := range m.consents {
+		if m.consents[i].Username == username {
+			m.consents[i].Username = placeholder
+		}
+	}
+	return nil
+}
+
+// Deep copies, so stored values never share slices, maps or pointers with callers
+
+func cloneUser(user User) User {
+	user.CompletedLevels = slices.Clone(user.CompletedLevels)
+	user.TwoFactor.RecoveryCodes = slices.Clone(user.TwoFactor.RecoveryCodes)
+	if user.EmailVerified != nil {
+		verified := *user.EmailVerified
+		user.EmailVerified = &verified
+	}
+	if user.ParentalConsent != nil {
+		consent := *user.ParentalConsent
+		if consent.GrantedAt != nil {
+			grantedAt := *consent.GrantedAt
+			consent.GrantedAt = &grantedAt
+		}
+		user.ParentalConsent = &consent
+	}
+	if user.DeletionScheduledFor != nil {
+		scheduledFor := *user.DeletionScheduledFor
+		user.DeletionScheduledFor = &scheduledFor
+	}
+	return user
+}
+
+func cloneLobby(lobby Lobby) Lobby {
+	lobby.Participants = slices.Clone(lobby.Participants)
+	lobby.Scores = maps.Clone(lobby.Scores)
+	lobby.Questions = slices.Clone(lobby.Questions)
+	for i := range lobby.Questions {
+		lobby.Questions[i].Options = slices.Clone(lobby.Questions[i].Options)
+	}
+	return lobby
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Prometheus metrics, served at /metrics along with the Go runtime and
+// process metrics of the default registry
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time to serve HTTP requests by route pattern and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	mongoCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongodb_command_duration_seconds",
+		Help:    "Time taken by MongoDB commands by command name and outcome.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"command", "outcome"})
+
+	loginsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "logins_total",
+		Help: "Login attempts by result, succeeded or failed.",
+	}, []string{"result"})
+	signupsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "signups_total",
+		Help: "Accounts created.",
+	})
+	answersSubmittedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "game_answers_submitted_total",
+		Help: "Multiplayer answers scored, by result, correct or wrong.",
+	}, []string{"result"})
+	gamesCompletedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "games_completed_total",
+		Help: "Multiplayer games ended and credited to the players.",
+	})
+
+	lobbiesExpiredTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lobbies_expired_total",
+		Help: "Waiting lobbies deleted by the janitor.",
+	})
+	lobbiesArchivedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lobbies_archived_total",
+		Help: "Ended lobbies archived by the janitor.",
+	})
+	lobbiesAbandonedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "lobbies_abandoned_total",
+		Help: "Active lobbies whose game stopped progressing, ended by the janitor.",
+	})
+
+	deprecatedRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "deprecated_requests_total",
+		Help: "Requests served by deprecated routes, by route pattern.",
+	}, []string{"route"})
+)
+
+// Route label of requests no pattern matched, so stray paths cannot inflate
+// the number of series
+const unmatchedRoute = "unmatched"
+
+// Lobby statuses reported by the lobbies gauge
+var gaugedLobbyStatuses = []string{"waiting", "active"}
+
+// Register the metrics read from the server's state at scrape time
+func (s *Server) registerMetrics(registerer prometheus.Registerer) {
+	registerer.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "websocket_connections",
+			Help: "Open WebSocket connections.",
+		}, func() float64 { return float64(s.openWebSocketCount()) }),
+		&lobbyCollector{lobbies: s.lobbies},
+	)
+}
+
+// Serve /metrics to requests with the bearer token. Only mounted when a
+// token is configured.
+func (s *Server) metricsHandler() http.HandlerFunc {
+	metrics := promhttp.Handler()
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.metricsToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid metrics token")
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	}
+}
+
+// Counts lobbies by status from the store on every scrape, so the gauge is
+// right no matter which instance created or ended them
+type lobbyCollector struct {
+	lobbies LobbyStore
+}
+
+var lobbiesDesc = prometheus.NewDesc("lobbies", "Lobbies by status.", []string{"status"}, nil)
+
+func (c *lobbyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lobbiesDesc
+}
+
+func (c *lobbyCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+
+	counts, err := c.lobbies.CountLobbiesByStatus(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(lobbiesDesc, err)
+		return
+	}
+	for _, status := range gaugedLobbyStatuses {
+		ch <- prometheus.MustNewConstMetric(lobbiesDesc, prometheus.GaugeValue, float64(counts[status]), status)
+	}
+}
+
+// Middleware recording the count and duration of every request, labelled
+// with the pattern the mux matched rather than the raw path
+func instrumentHTTP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(recorder, r)
+
+		// The mux fills in the pattern on the request it was given
+		route := r.Pattern
+		if route == "" {
+			route = unmatchedRoute
+		}
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// WebSocket upgrades take over the connection
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Driver hook timing every MongoDB command
+func mongoCommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			mongoCommandDuration.WithLabelValues(e.CommandName, "succeeded").Observe(e.Duration.Seconds())
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			mongoCommandDuration.WithLabelValues(e.CommandName, "failed").Observe(e.Duration.Seconds())
+		},
+	}
+}
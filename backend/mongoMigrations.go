@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// One step of the MongoDB schema: indexes to create or documents to reshape.
+// Applied versions are recorded in the schema_migrations collection so each
+// runs once per database. Migrations must be idempotent, since two instances
+// starting together may both apply the same version. Never edit a migration
+// that has shipped; add a new one instead.
+type mongoMigration struct {
+	Version     int
+	Description string
+	Apply       func(ctx context.Context, db *mongo.Database) error
+}
+
+// Record of an applied migration
+type appliedMigration struct {
+	Version     int `bson:"_id"`
+	Description string
+	AppliedAt   time.Time
+}
+
+var mongoMigrations = []mongoMigration{
+	{
+		Version:     1,
+		Description: "unique index on users.username, index on users.email",
+		Apply: func(ctx context.Context, db *mongo.Database) error {
+			users := db.Collection("users")
+			// The unique index cannot be built while duplicates exist, so name
+			// them instead of failing with a bare duplicate key error
+			duplicates, err := duplicateValues(ctx, users, "username")
+			if err != nil {
+				return err
+			}
+			if len(duplicates) > 0 {
+				return fmt.Errorf("usernames used by more than one account must be resolved by hand first: %s", strings.Join(duplicates, ", "))
+			}
+
+			_, err = users.Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetName("username_unique").SetUnique(true)},
+				{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetName("email")},
+			})
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "indexes on lobby status/createdat and participants",
+		Apply: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("lobbies").Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "status", Value: 1}, {Key: "createdat", Value: 1}}, Options: options.Index().SetName("status_createdat")},
+				{Keys: bson.D{{Key: "createdat", Value: 1}}, Options: options.Index().SetName("createdat")},
+				{Keys: bson.D{{Key: "participants", Value: 1}}, Options: options.Index().SetName("participants")},
+			})
+			return err
+		},
+	},
+	{
+		Version:     3,
+		Description: "indexes on tokens, audit and consents",
+		Apply: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("tokens").Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "tokenhash", Value: 1}}, Options: options.Index().SetName("tokenhash_unique").SetUnique(true)},
+				{Keys: bson.D{{Key: "username", Value: 1}, {Key: "purpose", Value: 1}}, Options: options.Index().SetName("username_purpose")},
+			})
+			if err != nil {
+				return err
+			}
+
+			_, err = db.Collection("audit").Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "timestamp", Value: -1}}, Options: options.Index().SetName("timestamp")},
+				{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "timestamp", Value: -1}}, Options: options.Index().SetName("actor_timestamp")},
+				{Keys: bson.D{{Key: "target", Value: 1}, {Key: "timestamp", Value: -1}}, Options: options.Index().SetName("target_timestamp")},
+			})
+			if err != nil {
+				return err
+			}
+
+			_, err = db.Collection("consents").Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetName("username"),
+			})
+			return err
+		},
+	},
+	{
+		Version:     4,
+		Description: "convert string and missing streakdata dates to dates",
+		Apply: func(ctx context.Context, db *mongo.Database) error {
+			// Early signups stored the dates as sent by the frontend, e.g.
+			// "2024-09-01" or the placeholder "0000-00-00", and some documents
+			// have no streakdata at all. Unparseable and missing dates become
+			// Go's zero time, which is what a new account gets.
+			zero := time.Time{}
+			toDate := func(field string) bson.M {
+				path := "$streakdata." + field
+				return bson.M{"$switch": bson.M{
+					"branches": bson.A{
+						bson.M{"case": bson.M{"$eq": bson.A{bson.M{"$type": path}, "date"}}, "then": path},
+						bson.M{"case": bson.M{"$eq": bson.A{bson.M{"$type": path}, "string"}}, "then": bson.M{"$dateFromString": bson.M{
+							"dateString": path,
+							"format":     "%Y-%m-%d",
+							"onError":    zero,
+						}}},
+					},
+					"default": zero,
+				}}
+			}
+
+			filter := bson.M{"$or": bson.A{
+				bson.M{"streakdata.latestplayed": bson.M{"$not": bson.M{"$type": "date"}}},
+				bson.M{"streakdata.lateststreakstartdate": bson.M{"$not": bson.M{"$type": "date"}}},
+			}}
+			update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+				"streakdata": bson.M{
+					"latestplayed":          toDate("latestplayed"),
+					"lateststreakstartdate": toDate("lateststreakstartdate"),
+				},
+			}}}}
+
+			result, err := db.Collection("users").UpdateMany(ctx, filter, update)
+			if err != nil {
+				return err
+			}
+			slog.InfoContext(ctx, "Converted streak data", "users", result.ModifiedCount)
+			return nil
+		},
+	},
+	{
+		Version:     5,
+		Description: "endedat on ended lobbies, index on lobby status/endedat",
+		Apply: func(ctx context.Context, db *mongo.Database) error {
+			lobbies := db.Collection("lobbies")
+			// Games that ended before endedat was recorded count from creation
+			_, err := lobbies.UpdateMany(ctx,
+				bson.M{"status": bson.M{"$in": bson.A{"ended", "archived"}}, "endedat": nil},
+				mongo.Pipeline{{{Key: "$set", Value: bson.M{"endedat": "$createdat"}}}},
+			)
+			if err != nil {
+				return err
+			}
+
+			_, err = lobbies.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "status", Value: 1}, {Key: "endedat", Value: 1}}, Options: options.Index().SetName("status_endedat"),
+			})
+			return err
+		},
+	},
+	{
+		Version:     6,
+		Description: "index on user multiplayerscore/username for the leaderboard",
+		Apply: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "multiplayerscore", Value: -1}, {Key: "username", Value: 1}},
+				Options: options.Index().SetName("multiplayerscore_username"),
+			})
+			return err
+		},
+	},
+	{
+		Version:     7,
+		Description: "index on user deletionscheduledfor for the account purge",
+		Apply: func(ctx context.Context, db *mongo.Database) error {
+			// Only the few accounts with a deletion scheduled are indexed
+			_, err := db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "deletionscheduledfor", Value: 1}},
+				Options: options.Index().SetName("deletionscheduledfor").
+					SetPartialFilterExpression(bson.M{"deletionscheduledfor": bson.M{"$type": "date"}}),
+			})
+			return err
+		},
+	},
+	{
+		Version:     8,
+		Description: "progressat on active lobbies, index on lobby status/progressat",
+		Apply: func(ctx context.Context, db *mongo.Database) error {
+			lobbies := db.Collection("lobbies")
+			// Games already active count from creation
+			_, err := lobbies.UpdateMany(ctx,
+				bson.M{"status": "active", "progressat": nil},
+				mongo.Pipeline{{{Key: "$set", Value: bson.M{"progressat": "$createdat"}}}},
+			)
+			if err != nil {
+				return err
+			}
+
+			_, err = lobbies.Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "status", Value: 1}, {Key: "progressat", Value: 1}}, Options: options.Index().SetName("status_progressat"),
+			})
+			return err
+		},
+	},
+}
+
+// Values of a field shared by more than one document
+func duplicateValues(ctx context.Context, collection *mongo.Collection, field string) ([]string, error) {
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$" + field, "count": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []struct {
+		Value string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	values := make([]string, len(groups))
+	for i, group := range groups {
+		values[i] = group.Value
+	}
+	return values, nil
+}
+
+// Apply every migration not yet recorded in schema_migrations, in order
+func migrateMongo(ctx context.Context, db *mongo.Database) error {
+	history := db.Collection("schema_migrations")
+
+	cursor, err := history.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var done []appliedMigration
+	if err := cursor.All(ctx, &done); err != nil {
+		return err
+	}
+	applied := make(map[int]bool)
+	for _, migration := range done {
+		applied[migration.Version] = true
+	}
+
+	for _, migration := range mongoMigrations {
+		if applied[migration.Version] {
+			continue
+		}
+
+		if err := migration.Apply(ctx, db); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+
+		_, err := history.InsertOne(ctx, appliedMigration{
+			Version:     migration.Version,
+			Description: migration.Description,
+			AppliedAt:   time.Now(),
+		})
+		// Another instance finished the same migration first
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		slog.InfoContext(ctx, "Applied schema migration", "version", migration.Version, "description", migration.Description)
+	}
+	return nil
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Store backed by a MongoDB database, "game" unless configured otherwise.
+// Documents use the driver's default field names, i.e. the lowercased Go
+// field names.
+type MongoStore struct {
+	client   *mongo.Client
+	users    *mongo.Collection
+	lobbies  *mongo.Collection
+	tokens   *mongo.Collection // single-use tokens such as password resets
+	audit    *mongo.Collection // append-only security audit trail
+	consents *mongo.Collection // parental consent records, kept for compliance
+	history  *mongo.Collection // applied schema migrations
+	restores *mongo.Collection // how far an interrupted restore got
+}
+
+// Connect to MongoDB, check the connection and apply pending migrations
+func NewMongoStore(mongoURI, database string) (*MongoStore, error) {
+	serverAPI := options.ServerAPI(options.ServerAPIVersion1)
+	clientOptions := options.Client().ApplyURI(mongoURI).SetServerAPIOptions(serverAPI).SetMonitor(mongoCommandMonitor())
+	client, err := mongo.Connect(context.TODO(), clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Test the connection
+	err = client.Ping(context.TODO(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	db := client.Database(database)
+	if err := migrateMongo(context.TODO(), db); err != nil {
+		client.Disconnect(context.TODO())
+		return nil, err
+	}
+
+	return &MongoStore{
+		client:   client,
+		users:    db.Collection("users"),
+		lobbies:  db.Collection("lobbies"),
+		tokens:   db.Collection("tokens"),
+		audit:    db.Collection("audit"),
+		consents: db.Collection("consents"),
+		history:  db.Collection("schema_migrations"),
+		restores: db.Collection("restore_progress"),
+	}, nil
+}
+
+func (m *MongoStore) Ping(ctx context.Context) error {
+	if err := m.client.Ping(ctx, nil); err != nil {
+		return err
+	}
+
+	versions := make([]int, len(mongoMigrations))
+	for i, migration := range mongoMigrations {
+		versions[i] = migration.Version
+	}
+	applied, err := m.history.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": versions}})
+	if err != nil {
+		return err
+	}
+	if int(applied) < len(mongoMigrations) {
+		return errSchemaBehind(int(applied), len(mongoMigrations))
+	}
+	return nil
+}
+
+func (m *MongoStore) Close(ctx context.Context) error {
+	return m.client.Disconnect(ctx)
+}
+
+// Decode a single document, mapping a missing document to ErrNotFound
+func decodeOne(result *mongo.SingleResult, v interface{}) error {
+	err := result.Decode(v)
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Filter on the version of a document read at the given version. Documents
+// written before versioning have no version field and count as version 0.
+func versionFilter(version int) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return version
+}
+
+// Explain a conditional write that matched nothing: the document is either
+// gone or was changed by someone else
+func missingOrConflict(ctx context.Context, collection *mongo.Collection, filter bson.M) error {
+	count, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return ErrConflict
+}
+
+// Users
+
+func (m *MongoStore) GetUser(ctx context.Context, username string) (User, error) {
+	var user User
+	err := decodeOne(m.users.FindOne(ctx, bson.M{"username": username}), &user)
+	return user, err
+}
+
+func (m *MongoStore) FindUserByEmail(ctx context.Context, email string) (User, error) {
+	var user User
+	err := decodeOne(m.users.FindOne(ctx, bson.M{"email": email}), &user)
+	return user, err
+}
+
+func (m *MongoStore) ListUsers(ctx context.Context) ([]User, error) {
+	cursor, err := m.users.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "username", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	err = cursor.All(ctx, &users)
+	return users, err
+}
+
+func (m *MongoStore) TopUsersByScore(ctx context.Context, limit int) ([]User, error) {
+	filter := bson.M{
+		"emailverified": bson.M{"$ne": false},
+		"$or":           bson.A{bson.M{"parentalconsent": nil}, bson.M{"parentalconsent.grantedat": bson.M{"$ne": nil}}},
+	}
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "multiplayerscore", Value: -1}, {Key: "username", Value: 1}}).
+		SetLimit(int64(limit))
+	cursor, err := m.users.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	err = cursor.All(ctx, &users)
+	return users, err
+}
+
+func (m *MongoStore) UsersPendingDeletion(ctx context.Context, before time.Time) ([]User, error) {
+	findOptions := options.Find().SetSort(bson.D{{Key: "deletionscheduledfor", Value: 1}, {Key: "username", Value: 1}})
+	cursor, err := m.users.Find(ctx, bson.M{"deletionscheduledfor": bson.M{"$lte": before}}, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	err = cursor.All(ctx, &users)
+	return users, err
+}
+
+func (m *MongoStore) CreateUser(ctx context.Context, user User) error {
+	// The unique username index makes this safe against concurrent signups
+	_, err := m.users.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrUserExists
+	}
+	return err
+}
+
+func (m *MongoStore) SaveUser(ctx context.Context, user User) error {
+	filter := bson.M{"username": user.Username, "version": versionFilter(user.Version)}
+	user.Version++
+	result, err := m.users.ReplaceOne(ctx, filter, user)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return missingOrConflict(ctx, m.users, bson.M{"username": user.Username})
+	}
+	return nil
+}
+
+func (m *MongoStore) DeleteUser(ctx context.Context, username string) error {
+	_, err := m.users.DeleteOne(ctx, bson.M{"username": username})
+	return err
+}
+
+func (m *MongoStore) IncrementFailedLogins(ctx context.Context, username string) (int, error) {
+	var user User
+	err := decodeOne(m.users.FindOneAndUpdate(ctx,
+		bson.M{"username": username},
+		bson.M{"$inc": bson.M{"failedloginattempts": 1, "version": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	), &user)
+	return user.FailedLoginAttempts, err
+}
+
+func (m *MongoStore) AddMultiPlayerScore(ctx context.Context, username string, delta int) error {
+	result, err := m.users.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$inc": bson.M{"multiplayerscore": delta, "version": 1}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *MongoStore) UseTOTPStep(ctx context.Context, username string, step int64) (bool, error) {
+	// Conditional on the stored step so two requests racing with the same
+	// code cannot both succeed
+	result, err := m.users.UpdateOne(ctx,
+		bson.M{"username": username, "twofactor.lastusedstep": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"twofactor.lastusedstep": step}, "$inc": bson.M{"version": 1}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (m *MongoStore) UseRecoveryCode(ctx context.Context, username, codeHash string) (bool, error) {
+	result, err := m.users.UpdateOne(ctx,
+		bson.M{"username": username, "twofactor.recoverycodes": codeHash},
+		bson.M{"$pull": bson.M{"twofactor.recoverycodes": codeHash}, "$inc": bson.M{"version": 1}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// Lobbies
+
+func (m *MongoStore) CreateLobby(ctx context.Context, lobby Lobby) error {
+	_, err := m.lobbies.InsertOne(ctx, lobby)
+	return err
+}
+
+func (m *MongoStore) GetLobby(ctx context.Context, id string) (Lobby, error) {
+	var lobby Lobby
+	err := decodeOne(m.lobbies.FindOne(ctx, bson.M{"_id": id}), &lobby)
+	return lobby, err
+}
+
+func (m *MongoStore) ListLobbies(ctx context.Context) ([]Lobby, error) {
+	return m.findLobbies(ctx, bson.M{})
+}
+
+func (m *MongoStore) ListLobbiesByParticipant(ctx context.Context, username string) ([]Lobby, error) {
+	return m.findLobbies(ctx, bson.M{"participants": username})
+}
+
+func (m *MongoStore) SaveLobby(ctx context.Context, lobby Lobby) error {
+	filter := bson.M{"_id": lobby.ID, "version": versionFilter(lobby.Version)}
+	lobby.Version++
+	result, err := m.lobbies.ReplaceOne(ctx, filter, lobby)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return missingOrConflict(ctx, m.lobbies, bson.M{"_id": lobby.ID})
+	}
+	return nil
+}
+
+func (m *MongoStore) JoinLobby(ctx context.Context, id, username string, capacity int) (Lobby, error) {
+	filter := bson.M{
+		"_id":    id,
+		"status": "waiting",
+		// Fewer than capacity participants: the element at index capacity-1 is missing
+		"participants." + strconv.Itoa(capacity-1): bson.M{"$exists": false},
+		"participants": bson.M{"$ne": username},
+	}
+	// A pipeline update, so the status can depend on the participant count
+	// it started from
+	participants := bson.M{"$ifNull": bson.A{"$participants", bson.A{}}}
+	fills := bson.M{"$gte": bson.A{bson.M{"$size": participants}, capacity - 1}}
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"participants": bson.M{"$concatArrays": bson.A{participants, bson.A{username}}},
+		"status":       bson.M{"$cond": bson.A{fills, "active", "$status"}},
+		"progressat":   bson.M{"$cond": bson.A{fills, time.Now(), "$progressat"}},
+		// Lobbies written before versioning have no version and count as 0
+		"version": bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}},
+	}}}}
+
+	var lobby Lobby
+	err := decodeOne(m.lobbies.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)), &lobby)
+	if err != ErrNotFound {
+		return lobby, err
+	}
+
+	// Nothing matched: find out why
+	current, err := m.GetLobby(ctx, id)
+	if err != nil {
+		return Lobby{}, err
+	}
+	return Lobby{}, joinRefusal(current, username)
+}
+
+func (m *MongoStore) ListLobbiesByStatus(ctx context.Context, status string) ([]Lobby, error) {
+	return m.findLobbies(ctx, bson.M{"status": status})
+}
+
+func (m *MongoStore) CountLobbiesByStatus(ctx context.Context) (map[string]int, error) {
+	cursor, err := m.lobbies.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		Status string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(groups))
+	for _, group := range groups {
+		counts[group.Status] = group.Count
+	}
+	return counts, nil
+}
+
+func (m *MongoStore) DeleteWaitingLobbies(ctx context.Context, createdBefore time.Time, capacity int) (int, error) {
+	result, err := m.lobbies.DeleteMany(ctx, bson.M{
+		"status":    "waiting",
+		"createdat": bson.M{"$lt": createdBefore},
+		// Fewer than capacity participants: the last position is free
+		"participants." + strconv.Itoa(capacity-1): bson.M{"$exists": false},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(result.DeletedCount), nil
+}
+
+func (m *MongoStore) ArchiveEndedLobbies(ctx context.Context, endedBefore time.Time) (int, error) {
+	result, err := m.lobbies.UpdateMany(ctx,
+		bson.M{"status": "ended", "endedat": bson.M{"$lt": endedBefore}},
+		bson.M{"$set": bson.M{"status": "archived"}, "$inc": bson.M{"version": 1}})
+	if err != nil {
+		return 0, err
+	}
+	return int(result.ModifiedCount), nil
+}
+
+func (m *MongoStore) EndStaleLobbies(ctx context.Context, progressBefore time.Time) (int, error) {
+	result, err := m.lobbies.UpdateMany(ctx,
+		bson.M{"status": "active", "progressat": bson.M{"$lt": progressBefore}},
+		bson.M{"$set": bson.M{"status": "ended", "endedat": time.Now()}, "$inc": bson.M{"version": 1}})
+	if err != nil {
+		return 0, err
+	}
+	return int(result.ModifiedCount), nil
+}
+
+// Matching lobbies, oldest first
+func (m *MongoStore) findLobbies(ctx context.Context, filter bson.M) ([]Lobby, error) {
+	cursor, err := m.lobbies.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "createdat", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	lobbies := []Lobby{}
+	err = cursor.All(ctx, &lobbies)
+	return lobbies, err
+}
+
+// Tokens
+
+func (m *MongoStore) CreateToken(ctx context.Context, token OneTimeToken) error {
+	_, err := m.tokens.UpdateMany(ctx,
+		bson.M{"purpose": token.Purpose, "username": token.Username, "usedat": nil},
+		bson.M{"$set": bson.M{"usedat": token.CreatedAt}},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.tokens.InsertOne(ctx, token)
+	return err
+}
+
+func (m *MongoStore) ConsumeToken(ctx context.Context, purpose, tokenHash string, now time.Time) (OneTimeToken, error) {
+	filter := bson.M{
+		"tokenhash": tokenHash,
+		"purpose":   purpose,
+		"usedat":    nil,
+		"expiresat": bson.M{"$gt": now},
+	}
+
+	var token OneTimeToken
+	err := decodeOne(m.tokens.FindOneAndUpdate(ctx, filter, bson.M{"$set": bson.M{"usedat": now}}), &token)
+	return token, err
+}
+
+func (m *MongoStore) DeleteUserTokens(ctx context.Context, username string) error {
+	_, err := m.tokens.DeleteMany(ctx, bson.M{"username": username})
+	return err
+}
+
+// Audit log
+
+func (m *MongoStore) AppendAuditEvent(ctx context.Context, event AuditEvent) error {
+	_, err := m.audit.InsertOne(ctx, event)
+	return err
+}
+
+func (m *MongoStore) QueryAuditEvents(ctx context.Context, query AuditQuery) ([]AuditEvent, error) {
+	filter := bson.M{}
+	if query.User != "" {
+		filter["$or"] = bson.A{bson.M{"actor": query.User}, bson.M{"target": query.User}}
+	}
+	if query.Action != "" {
+		filter["action"] = query.Action
+	}
+
+	timeRange := bson.M{}
+	if !query.From.IsZero() {
+		timeRange["$gte"] = query.From
+	}
+	if !query.To.IsZero() {
+		timeRange["$lte"] = query.To
+	}
+	if len(timeRange) > 0 {
+		filter["timestamp"] = timeRange
+	}
+
+	findOptions := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+	if query.Limit > 0 {
+		findOptions.SetLimit(int64(query.Limit))
+	}
+
+	cursor, err := m.audit.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	events := []AuditEvent{}
+	err = cursor.All(ctx, &events)
+	return events, err
+}
+
+func (m *MongoStore) PseudonymizeAuditEvents(ctx context.Context, username, placeholder string) error {
+	if _, err := m.audit.UpdateMany(ctx, bson.M{"actor": username}, bson.M{"$set": bson.M{"actor": placeholder}}); err != nil {
+		return err
+	}
+	_, err := m.audit.UpdateMany(ctx, bson.M{"target": username}, bson.M{"$set": bson.M{"target": placeholder}})
+	return err
+}
+
+// Parental consent records
+
+func (m *MongoStore) AddConsentRecord(ctx context.Context, record ConsentRecord) error {
+	_, err := m.consents.InsertOne(ctx, record)
+	return err
+}
+
+func (m *MongoStore) ListConsentRecords(ctx context.Context, username string) ([]ConsentRecord, error) {
+	filter := bson.M{}
+	if username != "" {
+		filter["username"] = username
+	}
+	cursor, err := m.consents.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "grantedat", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	records := []ConsentRecord{}
+	err = cursor.All(ctx, &records)
+	return records, err
+}
+
+func (m *MongoStore) PseudonymizeConsentRecords(ctx context.Context, username, placeholder string) error {
+	_, err := m.consents.UpdateMany(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"username": placeholder}})
+	return err
+}
+
+// Backup and restore
+
+// Call fn with a context whose reads all see the data as of one moment.
+// Snapshot reads need a replica set or a sharded cluster; against a
+// standalone server fn reads the live data, with a warning.
+func (m *MongoStore) withSnapshot(ctx context.Context, fn func(ctx context.Context) error) error {
+	var hello bson.M
+	if err := m.client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return err
+	}
+	if hello["setName"] == nil && hello["msg"] != "isdbgrid" {
+		slog.WarnContext(ctx, "MongoDB is a standalone server without snapshot reads; changes made while the backup runs may be partly included")
+		return fn(ctx)
+	}
+
+	session, err := m.client.StartSession(options.Session().SetSnapshot(true))
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	return fn(mongo.NewSessionContext(ctx, session))
+}
+
+// The single document in restore_progress while a restore is under way
+type mongoRestoreProgress struct {
+	ID       string `bson:"_id"`
+	Checksum string // of the archive being restored
+	Done     int    // records written, in archive order
+}
+
+const mongoRestoreProgressID = "restore"
+
+func (m *MongoStore) restoreProgress(ctx context.Context) (string, int, error) {
+	var progress mongoRestoreProgress
+	err := decodeOne(m.restores.FindOne(ctx, bson.M{"_id": mongoRestoreProgressID}), &progress)
+	if err == ErrNotFound {
+		return "", 0, nil
+	}
+	return progress.Checksum, progress.Done, err
+}
+
+func (m *MongoStore) saveRestoreProgress(ctx context.Context, checksum string, done int) error {
+	progress := mongoRestoreProgress{ID: mongoRestoreProgressID, Checksum: checksum, Done: done}
+	_, err := m.restores.ReplaceOne(ctx, bson.M{"_id": mongoRestoreProgressID}, progress, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (m *MongoStore) clearRestoreProgress(ctx context.Context) error {
+	_, err := m.restores.DeleteOne(ctx, bson.M{"_id": mongoRestoreProgressID})
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// Purposes a one-time token can be issued for
+const (
+	passwordResetPurpose     = "password-reset"
+	emailVerificationPurpose = "email-verification"
+	parentalConsentPurpose   = "parental-consent"
+
+	passwordResetTTL     = time.Hour
+	emailVerificationTTL = 48 * time.Hour
+	parentalConsentTTL   = 14 * 24 * time.Hour
+)
+
+// A single-use token kept in the token store. Only the SHA-256 hash of
+// the token is stored, so a database leak does not expose usable links.
+type OneTimeToken struct {
+	TokenHash string     `json:"-"`
+	Purpose   string     `json:"purpose"`
+	Username  string     `json:"username"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt"`
+}
+
+// Create a new token for a user and purpose, invalidating any earlier unused
+// tokens for the same purpose. Returns the raw token to put in the link.
+func (s *Server) issueOneTimeToken(ctx context.Context, purpose, username string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now()
+
+	err := s.tokens.CreateToken(ctx, OneTimeToken{
+		TokenHash: hashToken(token),
+		Purpose:   purpose,
+		Username:  username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Atomically mark a token as used and return it. Fails with errInvalidToken if
+// the token does not exist, has expired, or was already used.
+func (s *Server) consumeOneTimeToken(ctx context.Context, purpose, token string) (*OneTimeToken, error) {
+	consumed, err := s.tokens.ConsumeToken(ctx, purpose, hashToken(token), time.Now())
+	if err == ErrNotFound {
+		return nil, errInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &consumed, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Attempts made by updateUser and updateLobby before giving up with ErrConflict
+const maxUpdateAttempts = 5
+
+// Read-modify-write a user, starting over from a fresh copy whenever a
+// concurrent write wins. mutate may run more than once; returning an error
+// from it aborts the update without saving. Returns the saved user.
+func (s *Server) updateUser(ctx context.Context, username string, mutate func(user *User) error) (User, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		user, err := s.users.GetUser(ctx, username)
+		if err != nil {
+			return User{}, err
+		}
+		if err := mutate(&user); err != nil {
+			return User{}, err
+		}
+
+		err = s.users.SaveUser(ctx, user)
+		if err == ErrConflict {
+			continue
+		}
+		if err != nil {
+			return User{}, err
+		}
+		user.Version++
+		return user, nil
+	}
+	return User{}, ErrConflict
+}
+
+// Read-modify-write a lobby, like updateUser
+func (s *Server) updateLobby(ctx context.Context, id string, mutate func(lobby *Lobby) error) (Lobby, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		lobby, err := s.lobbies.GetLobby(ctx, id)
+		if err != nil {
+			return Lobby{}, err
+		}
+		if err := mutate(&lobby); err != nil {
+			return Lobby{}, err
+		}
+
+		err = s.lobbies.SaveLobby(ctx, lobby)
+		if err == ErrConflict {
+			continue
+		}
+		if err != nil {
+			return Lobby{}, err
+		}
+		lobby.Version++
+		return lobby, nil
+	}
+	return Lobby{}, ErrConflict
+}
+
+// Answer a failed save, telling the client to retry if it lost a race
+func writeSaveError(w http.ResponseWriter, err error, message string) {
+	switch err {
+	case ErrNotFound:
+		writeError(w, http.StatusNotFound, codeNotFound, "Not found")
+	case ErrConflict:
+		writeError(w, http.StatusConflict, codeConcurrentUpdate, "The record was changed by another request, please try again")
+	default:
+		writeError(w, http.StatusInternalServerError, codeInternal, message)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Default age below which an account needs a parent's approval
+const defaultParentalConsentAge = 13
+
+// Parental consent state for an account whose DOB puts it below the consent age
+type ParentalConsent struct {
+	ParentEmail string     `json:"parentEmail"`
+	RequestedAt time.Time  `json:"requestedAt"`
+	GrantedAt   *time.Time `json:"grantedAt"`
+}
+
+// Compliance record stored in the consents collection when a parent approves
+// an account. Never updated or deleted by the API.
+type ConsentRecord struct {
+	Username    string    `json:"username"`
+	ParentEmail string    `json:"parentEmail"`
+	DOB         time.Time `json:"dob"`
+	GrantedAt   time.Time `json:"grantedAt"`
+	IP          string    `json:"ip"`
+	UserAgent   string    `json:"userAgent"`
+}
+
+func (u User) awaitingParentalConsent() bool {
+	return u.ParentalConsent != nil && u.ParentalConsent.GrantedAt == nil
+}
+
+// Age in whole years on the given day
+func ageOn(dob, now time.Time) int {
+	age := now.Year() - dob.Year()
+	if now.Month() < dob.Month() || (now.Month() == dob.Month() && now.Day() < dob.Day()) {
+		age--
+	}
+	return age
+}
+
+// Whether someone born on dob needs a parent's approval to use the full app
+func (s *Server) requiresParentalConsent(dob time.Time) bool {
+	return ageOn(dob, time.Now()) < s.parentalConsentAge
+}
+
+// Email the parent or guardian a single-use approval link
+func (s *Server) sendParentalConsentEmail(ctx context.Context, user User) error {
+	token, err := s.issueOneTimeToken(ctx, parentalConsentPurpose, user.Username, parentalConsentTTL)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/parental-consent?token=%s", s.appBaseURL, url.QueryEscape(token))
+	return s.mailer.Send(Email{
+		To:      user.ParentalConsent.ParentEmail,
+		Subject: fmt.Sprintf("Please approve %s's account", user.FirstName),
+		Body: fmt.Sprintf("Hello,\n\n%s %s signed up with the username %q and gave this address as their parent or guardian.\n\n"+
+			"Until you approve the account, multiplayer games, chat and public leaderboards stay switched off. "+
+			"To approve it, open the link below within %v.\n\n%s\n\nIf you do not recognise this request, you can ignore this email.",
+			user.FirstName, user.LastName, user.Username, parentalConsentTTL, link),
+	})
+}
+
+// Record a parent's approval from the link in the consent email
+func (s *Server) handleGrantParentalConsent(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	token, err := s.consumeOneTimeToken(r.Context(), parentalConsentPurpose, requestData.Token)
+	if err == errInvalidToken {
+		writeValidationError(w, FieldError{Field: "token", Message: "Invalid or expired consent link"})
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to verify consent link")
+		return
+	}
+
+	user, err := s.users.GetUser(r.Context(), token.Username)
+	if err != nil || user.ParentalConsent == nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	now := time.Now()
+	record := ConsentRecord{
+		Username:    user.Username,
+		ParentEmail: user.ParentalConsent.ParentEmail,
+		DOB:         user.DOB,
+		GrantedAt:   now,
+		IP:          clientIP(r),
+		UserAgent:   r.UserAgent(),
+	}
+	if err := s.consents.AddConsentRecord(r.Context(), record); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to record consent")
+		return
+	}
+
+	_, err = s.updateUser(r.Context(), user.Username, func(user *User) error {
+		if user.ParentalConsent == nil {
+			return ErrNotFound
+		}
+		user.ParentalConsent.GrantedAt = &now
+		return nil
+	})
+	if err != nil {
+		writeSaveError(w, err, "Failed to update user")
+		return
+	}
+
+	s.recordAudit(r, "", auditParentalConsentGranted, user.Username, map[string]string{"parentEmail": record.ParentEmail})
+
+	writeMessage(w, http.StatusOK, "Parental consent recorded")
+}
+
+// Send the consent email again, for the authenticated child account
+func (s *Server) handleResendParentalConsent(w http.ResponseWriter, r *http.Request) {
+	user, err := s.users.GetUser(r.Context(), authenticatedUsername(r))
+	if err != nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	if !user.awaitingParentalConsent() {
+		writeError(w, http.StatusConflict, codeConflict, "No parental consent is pending for this account")
+		return
+	}
+
+	if err := s.sendParentalConsentEmail(r.Context(), user); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to send parental consent email", "error", err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to send parental consent email")
+		return
+	}
+
+	writeMessage(w, http.StatusAccepted, "Parental consent email sent")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// Reset requests accepted from one IP address, and reset emails sent for
+	// one account, within resetRequestWindow. Requests for an account over its
+	// limit get the usual response but no email, so the endpoint cannot be
+	// used to flood someone's inbox or to tell which accounts exist.
+	maxResetRequestsPerIP    = 10
+	maxResetEmailsPerAccount = 3
+	resetRequestWindow       = time.Hour
+)
+
+// Start a password reset: email the user a single-use reset link
+func (s *Server) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	if requestData.Username == "" && requestData.Email == "" {
+		writeValidationError(w, FieldError{Field: "username", Message: "Username or email is required"})
+		return
+	}
+
+	ip := clientIP(r)
+	if wait := s.resetIPLimiter.retryAfter(ip); wait > 0 {
+		writeRetryAfter(w, http.StatusTooManyRequests, "Too many password reset requests, try again later", wait)
+		return
+	}
+	s.resetIPLimiter.record(ip)
+
+	// The response is the same whether or not the account exists, so this
+	// endpoint cannot be used to find out which usernames are registered
+	const response = "If the account exists, a password reset email has been sent"
+
+	var user User
+	var err error
+	if requestData.Username != "" {
+		user, err = s.users.GetUser(r.Context(), requestData.Username)
+	} else {
+		user, err = s.users.FindUserByEmail(r.Context(), requestData.Email)
+	}
+	if err != nil {
+		writeMessage(w, http.StatusAccepted, response)
+		return
+	}
+	if s.resetAccountLimiter.retryAfter(user.Username) > 0 {
+		writeMessage(w, http.StatusAccepted, response)
+		return
+	}
+	s.resetAccountLimiter.record(user.Username)
+
+	token, err := s.issueOneTimeToken(r.Context(), passwordResetPurpose, user.Username, passwordResetTTL)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create reset token")
+		return
+	}
+
+	s.recordAudit(r, "", auditPasswordResetRequested, user.Username, nil)
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", s.appBaseURL, url.QueryEscape(token))
+	err = s.mailer.Send(Email{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to choose a new password. It expires in %v and can only be used once.\n\n%s\n\nIf you did not ask for this, you can ignore this email.",
+			user.FirstName, passwordResetTTL, link),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to send password reset email", "username", user.Username, "error", err)
+	}
+
+	writeMessage(w, http.StatusAccepted, response)
+}
+
+// Finish a password reset: set a new password using a valid reset token
+func (s *Server) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	if fields := validatePassword("newPassword", requestData.NewPassword); len(fields) > 0 {
+		writeValidationError(w, fields...)
+		return
+	}
+
+	newPasswordHash, err := HashPassword(requestData.NewPassword)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to hash new password")
+		return
+	}
+
+	token, err := s.consumeOneTimeToken(r.Context(), passwordResetPurpose, requestData.Token)
+	if err == errInvalidToken {
+		writeValidationError(w, FieldError{Field: "token", Message: "Invalid or expired reset token"})
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to verify reset token")
+		return
+	}
+
+	_, err = s.updateUser(r.Context(), token.Username, func(user *User) error {
+		user.PasswordHash = newPasswordHash
+		// Proving ownership of the email address also lifts any lockout
+		user.FailedLoginAttempts = 0
+		user.LockedUntil = time.Time{}
+		// and signs out every session, in case the old password leaked
+		user.TokenVersion++
+		return nil
+	})
+	if err == ErrNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeSaveError(w, err, "Failed to update password")
+		return
+	}
+
+	s.recordAudit(r, token.Username, auditPasswordReset, token.Username, nil)
+
+	writeMessage(w, http.StatusOK, "Password reset successfully")
+}
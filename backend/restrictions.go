@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Why an account may not use community features (multiplayer, chat, public
+// leaderboards) yet, or an empty string if nothing is holding it back
+func (u User) restrictionReason() string {
+	if u.isEmailUnverified() {
+		return "Please verify your email address first"
+	}
+	if u.awaitingParentalConsent() {
+		return "A parent or guardian has to approve this account first"
+	}
+	return ""
+}
+
+// Middleware that authenticates the caller and rejects accounts that are
+// still restricted
+func (s *Server) requireUnrestrictedAccount(next http.HandlerFunc) http.HandlerFunc {
+	return s.authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.users.GetUser(r.Context(), authenticatedUsername(r))
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "User not found")
+			return
+		}
+
+		if reason := user.restrictionReason(); reason != "" {
+			writeError(w, http.StatusForbidden, codeAccountRestricted, reason)
+			return
+		}
+
+		next(w, r)
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Roles a user can hold. Every new account starts as a student; teachers and
+// admins are promoted by an existing admin through /user/role, and the first
+// admin with the set-role command
+const (
+	RoleStudent = "student"
+	RoleTeacher = "teacher"
+	RoleAdmin   = "admin"
+)
+
+func isValidRole(role string) bool {
+	return role == RoleStudent || role == RoleTeacher || role == RoleAdmin
+}
+
+// Role of a user, treating accounts created before roles existed as students
+func (u User) EffectiveRole() string {
+	if u.Role == "" {
+		return RoleStudent
+	}
+	return u.Role
+}
+
+// Authorization middleware: authenticates the caller and only lets the request
+// through if their stored role is one of the allowed roles. The role is read
+// from the database on every request so promotions and demotions apply
+// immediately instead of waiting for the access token to expire.
+func (s *Server) requireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return s.authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.users.GetUser(r.Context(), authenticatedUsername(r))
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "User not found")
+			return
+		}
+
+		if !slices.Contains(roles, user.EffectiveRole()) {
+			writeError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+// Change the role of a user (admin only)
+func (s *Server) setUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	if !isValidRole(requestData.Role) {
+		writeValidationError(w, FieldError{Field: "role", Message: "Invalid role"})
+		return
+	}
+
+	// Admins cannot demote themselves, so there is always at least one admin left
+	if requestData.Username == authenticatedUsername(r) && requestData.Role != RoleAdmin {
+		writeError(w, http.StatusForbidden, codeForbidden, "Admins cannot change their own role")
+		return
+	}
+
+	_, err := s.updateUser(r.Context(), requestData.Username, func(user *User) error {
+		user.Role = requestData.Role
+		// Tokens carry no role, but sessions are renewed so a demoted user
+		// starts over with what the new role allows
+		user.TokenVersion++
+		return nil
+	})
+	if err == ErrNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		writeSaveError(w, err, "Failed to update role")
+		return
+	}
+
+	s.recordAudit(r, authenticatedUsername(r), auditRoleChanged, requestData.Username, map[string]string{"role": requestData.Role})
+
+	writeMessage(w, http.StatusOK, "Role updated successfully")
+}
+
+// Give an existing user a role from the command line, which is how the first
+// admin is made, since only admins can change roles through the API
+func runSetRoleCommand(ctx context.Context, store Store, args []string) error {
+	flags := flag.NewFlagSet("set-role", flag.ContinueOnError)
+	username := flags.String("user", "", "username of the account to change")
+	role := flags.String("role", RoleAdmin, "role to give: student, teacher or admin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *username == "" {
+		return errors.New("set-role: -user is required")
+	}
+	if !isValidRole(*role) {
+		return fmt.Errorf("set-role: unknown role %q, expected student, teacher or admin", *role)
+	}
+
+	user, err := store.GetUser(ctx, *username)
+	if err == ErrNotFound {
+		return fmt.Errorf("set-role: no user named %q", *username)
+	}
+	if err != nil {
+		return err
+	}
+
+	previous := user.EffectiveRole()
+	user.Role = *role
+	// As through the API, the user's sessions start over with the new role
+	user.TokenVersion++
+	if err := store.SaveUser(ctx, user); err == ErrConflict {
+		return errors.New("set-role: the user changed while being updated, run the command again")
+	} else if err != nil {
+		return err
+	}
+
+	err = store.AppendAuditEvent(ctx, AuditEvent{
+		Actor:     "system",
+		Action:    auditRoleChanged,
+		Target:    *username,
+		Timestamp: time.Now(),
+		Details:   map[string]string{"role": *role, "via": "set-role command"},
+	})
+	if err != nil {
+		slog.Error("Failed to write audit event", "action", auditRoleChanged, "target", *username, "error", err)
+	}
+
+	slog.Info("Changed role", "username", *username, "from", previous, "to", *role)
+	return nil
+}
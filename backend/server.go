@@ -2,65 +2,90 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"log"
 	"net/http"
-	"os"
-
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"slices"
+	"strings"
+	"time"
 )
 
-func NewServer(serverAddress string) *Server {
+func NewServer(config Config, store Store) *Server {
+	gamesCtx, stopGames := context.WithCancel(context.Background())
 	return &Server{
-		serverAddress: serverAddress,
-	}
-}
-
-// MongoDB connection setup
-func (s *Server) ConnectMongoDB() error {
-	mongoURI := os.Getenv("MONGO_URI")
-	if mongoURI == "" {
-		mongoURI = os.Getenv("MONGO_URI_LOCAL")
-	}
+		serverAddress: config.ListenAddress,
+		tokenSecret:   []byte(config.JWTSecret),
+		users:         store,
+		lobbies:       store,
+		tokens:        store,
+		auditLog:      store,
+		consents:      store,
+		store:         store,
+		mailer:        &MemoryMailer{},
+		appBaseURL:    config.AppBaseURL,
+		corsOrigins:   config.CORSOrigins,
+		loginLimiter:  newAttemptLimiter(maxFailedLoginsPerIP, ipFailureWindow),
 
-	serverAPI := options.ServerAPI(options.ServerAPIVersion1)
-	clientOptions := options.Client().ApplyURI(mongoURI).SetServerAPIOptions(serverAPI)
-	client, err := mongo.Connect(context.TODO(), clientOptions)
-	if err != nil {
-		return err
-	}
+		resetIPLimiter:       newAttemptLimiter(maxResetRequestsPerIP, resetRequestWindow),
+		resetAccountLimiter:  newAttemptLimiter(maxResetEmailsPerAccount, resetRequestWindow),
+		trustedProxies:       parseTrustedProxies(config.TrustedProxies),
+		parentalConsentAge:   config.ParentalConsentAge,
+		lobbyWaitingTTL:      time.Duration(config.Lobbies.WaitingTTL),
+		lobbyArchiveAfter:    time.Duration(config.Lobbies.ArchiveAfter),
+		lobbyStaleAfter:      time.Duration(config.Lobbies.StaleAfter),
+		lobbyCleanupInterval: time.Duration(config.Lobbies.CleanupInterval),
+		answerTimeout:        time.Duration(config.Game.AnswerTimeout),
+		correctAnswerPoints:  config.Game.CorrectAnswerPoints,
+		wrongAnswerPenalty:   config.Game.WrongAnswerPenalty,
+		shutdownTimeout:      time.Duration(config.ShutdownTimeout),
+		metricsToken:         config.MetricsToken,
 
-	// Test the connection
-	err = client.Ping(context.TODO(), nil)
-	if err != nil {
-		return err
+		games:     make(map[string]*liveGame),
+		gamesCtx:  gamesCtx,
+		stopGames: stopGames,
 	}
-
-	s.mongoClient = client
-	s.usersCollection = client.Database("game").Collection("users")
-	s.lobbiesCollection = client.Database("game").Collection("lobbies")
-	return nil
 }
 
-// Start the server
-func (s *Server) Run() {
-	http.HandleFunc("/user/login", s.corsMiddleware(s.userLoginHandler))
-	http.HandleFunc("/users", s.corsMiddleware(s.usersHandler))
-	http.HandleFunc("/user/", s.corsMiddleware(s.userHandler))
-	// http.HandleFunc("/game", s.corsMiddleware(s.gameHandler))
-	// http.HandleFunc("/lobby", s.corsMiddleware(s.lobbyHandler))
-
-	fmt.Println("Server running at", s.serverAddress)
-	log.Fatal(http.ListenAndServe(s.serverAddress, nil))
+// Routes served by the backend: every API version under its prefix. Patterns
+// name the method, so the mux answers 405 for any other, and CORS wraps the
+// whole mux so preflight requests reach it for every route.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, version := range s.apiVersions() {
+		for pattern, handler := range version.routes() {
+			method, path, _ := strings.Cut(pattern, " ")
+			if version.deprecation != nil {
+				handler = version.deprecation.wrap(handler)
+			}
+			mux.HandleFunc(method+" "+version.prefix+path, withRoute(handler))
+		}
+	}
+	// Probes and the status page are for operators and sit outside the
+	// versioned API
+	mux.HandleFunc("GET /healthz", withRoute(s.handleHealthz))
+	mux.HandleFunc("GET /readyz", withRoute(s.handleReadyz))
+	mux.HandleFunc("GET /status", withRoute(s.requireRole(s.handleStatus, RoleAdmin)))
+	if s.metricsToken != "" {
+		mux.HandleFunc("GET /metrics", withRoute(s.metricsHandler()))
+	}
+	// mux.HandleFunc("/game", s.corsMiddleware(s.gameHandler))
+	// mux.HandleFunc("/lobby", s.corsMiddleware(s.lobbyHandler))
+	return s.corsMiddleware(requestIDMiddleware(s.clientIPMiddleware(instrumentHTTP(mux.ServeHTTP))))
 }
 
-// CORS middleware
+// CORS middleware: browsers may call the API from the configured origins, or
+// from anywhere when they include "*"
 func (s *Server) corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		if slices.Contains(s.corsOrigins, "*") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Add("Vary", "Origin")
+			if origin := r.Header.Get("Origin"); slices.Contains(s.corsOrigins, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -70,3 +95,46 @@ func (s *Server) corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	}
 }
+
+// Authentication middleware: resolves the caller from the bearer access token
+// and stores the username in the request context
+func (s *Server) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid Authorization header")
+			return
+		}
+
+		user, err := s.authenticateToken(r.Context(), token, accessTokenType)
+		if err == errInvalidToken {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "Invalid or expired access token")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, codeInternal, "Failed to look up user")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), usernameContextKey, user.Username)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// Username of the authenticated caller, set by authMiddleware
+func authenticatedUsername(r *http.Request) string {
+	username, _ := r.Context().Value(usernameContextKey).(string)
+	return username
+}
+
+// Middleware that authenticates the caller and only lets them act on their
+// own account, as named by the {username} path parameter
+func (s *Server) requirePathUser(next http.HandlerFunc) http.HandlerFunc {
+	return s.authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("username") != authenticatedUsername(r) {
+			writeError(w, http.StatusForbidden, codeForbidden, "Cannot act on another user's account")
+			return
+		}
+		next(w, r)
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// One step of the SQL schema. Applied migrations are recorded in the
+// schema_migrations table, so every version runs exactly once per database.
+// Never edit a migration that has shipped; add a new one instead.
+type sqlMigration struct {
+	Version     int
+	Description string
+	Statements  func(d sqlDialect) []string
+}
+
+var sqlMigrations = []sqlMigration{
+	{
+		Version:     1,
+		Description: "create users, lobbies, tokens, audit and consent tables",
+		Statements: func(d sqlDialect) []string {
+			return []string{
+				`CREATE TABLE users (
+					username TEXT PRIMARY KEY,
+					first_name TEXT NOT NULL,
+					last_name TEXT NOT NULL,
+					email TEXT NOT NULL,
+					dob ` + d.timestampType + ` NOT NULL,
+					ongoing_level DOUBLE PRECISION NOT NULL,
+					multiplayer_score INTEGER NOT NULL,
+					password_hash TEXT NOT NULL,
+					streak_latest_played ` + d.timestampType + ` NOT NULL,
+					streak_latest_start ` + d.timestampType + ` NOT NULL,
+					profile_image_format TEXT NOT NULL,
+					profile_image_path TEXT NOT NULL,
+					role TEXT NOT NULL,
+					email_verified BOOLEAN,
+					failed_login_attempts INTEGER NOT NULL,
+					locked_until ` + d.timestampType + ` NOT NULL,
+					two_factor_enabled BOOLEAN NOT NULL,
+					two_factor_secret TEXT NOT NULL,
+					two_factor_pending_secret TEXT NOT NULL,
+					two_factor_last_used_step BIGINT NOT NULL,
+					parent_email TEXT,
+					consent_requested_at ` + d.timestampType + `,
+					consent_granted_at ` + d.timestampType + `,
+					deletion_scheduled_for ` + d.timestampType + `
+				)`,
+				`CREATE INDEX users_email ON users (email)`,
+				`CREATE TABLE completed_levels (
+					username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+					position INTEGER NOT NULL,
+					level_id INTEGER NOT NULL,
+					score INTEGER NOT NULL,
+					PRIMARY KEY (username, position)
+				)`,
+				`CREATE TABLE recovery_codes (
+					username TEXT NOT NULL REFERENCES users (username) ON DELETE CASCADE,
+					code_hash TEXT NOT NULL,
+					PRIMARY KEY (username, code_hash)
+				)`,
+				`CREATE TABLE lobbies (
+					id TEXT PRIMARY KEY,
+					creator TEXT NOT NULL,
+					status TEXT NOT NULL,
+					created_at ` + d.timestampType + ` NOT NULL,
+					current_index INTEGER NOT NULL
+				)`,
+				`CREATE INDEX lobbies_created_at ON lobbies (created_at)`,
+				`CREATE TABLE lobby_participants (
+					lobby_id TEXT NOT NULL REFERENCES lobbies (id) ON DELETE CASCADE,
+					position INTEGER NOT NULL,
+					username TEXT NOT NULL,
+					PRIMARY KEY (lobby_id, position)
+				)`,
+				`CREATE INDEX lobby_participants_username ON lobby_participants (username)`,
+				`CREATE TABLE lobby_scores (
+					lobby_id TEXT NOT NULL REFERENCES lobbies (id) ON DELETE CASCADE,
+					username TEXT NOT NULL,
+					score INTEGER NOT NULL,
+					PRIMARY KEY (lobby_id, username)
+				)`,
+				`CREATE TABLE lobby_questions (
+					lobby_id TEXT NOT NULL REFERENCES lobbies (id) ON DELETE CASCADE,
+					position INTEGER NOT NULL,
+					question_id TEXT NOT NULL,
+					question_text TEXT NOT NULL,
+					options TEXT NOT NULL,
+					correct_answer TEXT NOT NULL,
+					PRIMARY KEY (lobby_id, position)
+				)`,
+				`CREATE TABLE tokens (
+					token_hash TEXT PRIMARY KEY,
+					purpose TEXT NOT NULL,
+					username TEXT NOT NULL,
+					created_at ` + d.timestampType + ` NOT NULL,
+					expires_at ` + d.timestampType + ` NOT NULL,
+					used_at ` + d.timestampType + `
+				)`,
+				`CREATE INDEX tokens_username ON tokens (username, purpose)`,
+				`CREATE TABLE audit_events (
+					actor TEXT NOT NULL,
+					action TEXT NOT NULL,
+					target TEXT NOT NULL,
+					ip TEXT NOT NULL,
+					user_agent TEXT NOT NULL,
+					created_at ` + d.timestampType + ` NOT NULL,
+					details TEXT
+				)`,
+				`CREATE INDEX audit_events_created_at ON audit_events (created_at)`,
+				`CREATE TABLE consent_records (
+					username TEXT NOT NULL,
+					parent_email TEXT NOT NULL,
+					dob ` + d.timestampType + ` NOT NULL,
+					granted_at ` + d.timestampType + ` NOT NULL,
+					ip TEXT NOT NULL,
+					user_agent TEXT NOT NULL
+				)`,
+				`CREATE INDEX consent_records_username ON consent_records (username)`,
+			}
+		},
+	},
+	{
+		Version:     2,
+		Description: "add version columns for optimistic concurrency",
+		Statements: func(d sqlDialect) []string {
+			return []string{
+				`ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+				`ALTER TABLE lobbies ADD COLUMN version INTEGER NOT NULL DEFAULT 0`,
+			}
+		},
+	},
+	{
+		Version:     3,
+		Description: "index lobbies by status for the lobby list and janitor",
+		Statements: func(d sqlDialect) []string {
+			return []string{
+				`CREATE INDEX lobbies_status_created_at ON lobbies (status, created_at)`,
+			}
+		},
+	},
+	{
+		Version:     4,
+		Description: "record when lobbies ended, for archiving",
+		Statements: func(d sqlDialect) []string {
+			return []string{
+				`ALTER TABLE lobbies ADD COLUMN ended_at ` + d.timestampType,
+				// Games that ended before the column existed count from creation
+				`UPDATE lobbies SET ended_at = created_at WHERE status IN ('ended', 'archived')`,
+				`CREATE INDEX lobbies_status_ended_at ON lobbies (status, ended_at)`,
+			}
+		},
+	},
+	{
+		Version:     5,
+		Description: "add token versions for revoking sessions",
+		Statements: func(d sqlDialect) []string {
+			return []string{
+				`ALTER TABLE users ADD COLUMN token_version INTEGER NOT NULL DEFAULT 0`,
+			}
+		},
+	},
+	{
+		Version:     6,
+		Description: "index users by multiplayer score for the leaderboard",
+		Statements: func(d sqlDialect) []string {
+			return []string{
+				`CREATE INDEX users_multiplayer_score ON users (multiplayer_score DESC, username)`,
+			}
+		},
+	},
+	{
+		Version:     7,
+		Description: "index users by scheduled deletion for the account purge",
+		Statements: func(d sqlDialect) []string {
+			return []string{
+				`CREATE INDEX users_deletion_scheduled_for ON users (deletion_scheduled_for)`,
+			}
+		},
+	},
+	{
+		Version:     8,
+		Description: "record when games last progressed, for ending abandoned ones",
+		Statements: func(d sqlDialect) []string {
+			return []string{
+				`ALTER TABLE lobbies ADD COLUMN progress_at ` + d.timestampType,
+				// Games already active count from creation
+				`UPDATE lobbies SET progress_at = created_at WHERE status = 'active'`,
+				`CREATE INDEX lobbies_status_progress_at ON lobbies (status, progress_at)`,
+			}
+		},
+	},
+}
+
+// Bring the schema up to date, applying each pending migration in its own
+// transaction
+func (m *SQLStore) migrate(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at `+m.dialect.timestampType+` NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	applied := make(map[int]bool)
+	rows, err := m.db.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, migration := range sqlMigrations {
+		if applied[migration.Version] {
+			continue
+		}
+
+		err := m.inTx(ctx, func(tx *sql.Tx) error {
+			for _, statement := range migration.Statements(m.dialect) {
+				if _, err := tx.ExecContext(ctx, statement); err != nil {
+					return err
+				}
+			}
+			_, err := tx.ExecContext(ctx, m.dialect.rebind(`INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`),
+				migration.Version, migration.Description, dbTime(time.Now()))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+		slog.InfoContext(ctx, "Applied schema migration", "version", migration.Version, "description", migration.Description)
+	}
+	return nil
+}
@@ -0,0 +1,937 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// Differences between the SQL databases the SQLStore supports
+type sqlDialect struct {
+	name          string
+	driver        string // database/sql driver name
+	timestampType string
+	numbered      bool // placeholders are $1, $2, ... instead of ?
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"sqlite":   {name: "sqlite", driver: "sqlite", timestampType: "TIMESTAMP"},
+	"postgres": {name: "postgres", driver: "pgx", timestampType: "TIMESTAMPTZ", numbered: true},
+}
+
+// Rewrite ? placeholders for databases that number them
+func (d sqlDialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// Store backed by SQLite or PostgreSQL. The schema is created and upgraded by
+// the migrations in sqlMigrations.go when the store is opened.
+type SQLStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+	tx      *sql.Tx // on the copy withTransaction hands out, which runs every call in it
+}
+
+// Open a SQL database and migrate it to the latest schema. dialect is
+// "sqlite" (dsn is a file path or file: URI) or "postgres" (dsn is a
+// connection URL).
+func NewSQLStore(dialect, dsn string) (*SQLStore, error) {
+	d, ok := sqlDialects[dialect]
+	if !ok {
+		return nil, fmt.Errorf("unsupported SQL dialect %q", dialect)
+	}
+
+	if d.name == "sqlite" {
+		var err error
+		if dsn, err = sqliteDSN(dsn); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if d.name == "sqlite" {
+		// SQLite allows a single writer; one connection avoids "database is
+		// locked" errors between our own transactions
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := db.PingContext(context.TODO()); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &SQLStore{db: db, dialect: d}
+	if err := store.migrate(context.TODO()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// Turn a SQLite file path or file: URI into a URI with the options the store
+// relies on: sortable timestamps, enforced foreign keys and waiting for locks
+// rather than failing. Other query parameters of a URI are kept.
+func sqliteDSN(dsn string) (string, error) {
+	uri := &url.URL{Scheme: "file", Path: dsn, OmitHost: true}
+	if strings.HasPrefix(dsn, "file:") {
+		var err error
+		if uri, err = url.Parse(dsn); err != nil {
+			return "", fmt.Errorf("invalid SQLite URI: %w", err)
+		}
+	}
+
+	query, err := url.ParseQuery(uri.RawQuery)
+	if err != nil {
+		return "", fmt.Errorf("invalid SQLite URI query: %w", err)
+	}
+	query.Set("_time_format", "sqlite")
+	for _, pragma := range []string{"foreign_keys(1)", "busy_timeout(5000)"} {
+		if !slices.Contains(query["_pragma"], pragma) {
+			query.Add("_pragma", pragma)
+		}
+	}
+	uri.RawQuery = query.Encode()
+	return uri.String(), nil
+}
+
+func (m *SQLStore) Ping(ctx context.Context) error {
+	if err := m.db.PingContext(ctx); err != nil {
+		return err
+	}
+
+	// Versions are numbered from 1 without gaps
+	var applied int
+	err := m.db.QueryRowContext(ctx, m.dialect.rebind(`SELECT COUNT(*) FROM schema_migrations WHERE version <= ?`),
+		len(sqlMigrations)).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	if applied < len(sqlMigrations) {
+		return errSchemaBehind(applied, len(sqlMigrations))
+	}
+	return nil
+}
+
+func (m *SQLStore) Close(ctx context.Context) error {
+	return m.db.Close()
+}
+
+// Run fn in a transaction, committing if it returns nil. A store bound to a
+// transaction runs fn in that one.
+func (m *SQLStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if m.tx != nil {
+		return fn(m.tx)
+	}
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Call fn with a copy of the store bound to one transaction, committed if fn
+// returns nil. A read-only transaction sees the data as of one moment.
+func (m *SQLStore) withTransaction(ctx context.Context, readOnly bool, fn func(ctx context.Context, store Store) error) error {
+	options := &sql.TxOptions{ReadOnly: readOnly}
+	if readOnly {
+		options.Isolation = sql.LevelRepeatableRead
+	}
+	tx, err := m.db.BeginTx(ctx, options)
+	if err != nil {
+		return err
+	}
+	bound := *m
+	bound.tx = tx
+	if err := fn(ctx, &bound); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Where queries run: the bound transaction, if any, or the database
+func (m *SQLStore) conn() sqlQueryer {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.db
+}
+
+// Either a *sql.DB or a *sql.Tx
+type sqlQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (m *SQLStore) exec(ctx context.Context, q sqlQueryer, query string, args ...any) (sql.Result, error) {
+	return q.ExecContext(ctx, m.dialect.rebind(query), args...)
+}
+
+func (m *SQLStore) query(ctx context.Context, q sqlQueryer, query string, args ...any) (*sql.Rows, error) {
+	return q.QueryContext(ctx, m.dialect.rebind(query), args...)
+}
+
+// Run a query and call scan for every row. The rows are closed before
+// returning, which matters on SQLite where the next query needs the connection.
+func (m *SQLStore) eachRow(ctx context.Context, q sqlQueryer, scan func(rows *sql.Rows) error, query string, args ...any) error {
+	rows, err := m.query(ctx, q, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (m *SQLStore) queryRow(ctx context.Context, q sqlQueryer, query string, args ...any) *sql.Row {
+	return q.QueryRowContext(ctx, m.dialect.rebind(query), args...)
+}
+
+// Times are stored in UTC so they compare correctly as SQLite text
+func dbTime(t time.Time) time.Time {
+	return t.UTC()
+}
+
+func dbNullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: dbTime(*t), Valid: true}
+}
+
+func timePointer(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// Fail with ErrNotFound if an update or delete matched nothing
+func requireRowsAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Explain a conditional update that matched nothing: the row is either gone
+// or was changed by someone else
+func (m *SQLStore) missingOrConflict(ctx context.Context, tx *sql.Tx, table, keyColumn, key string) error {
+	var count int
+	err := m.queryRow(ctx, tx, `SELECT COUNT(*) FROM `+table+` WHERE `+keyColumn+` = ?`, key).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return ErrConflict
+}
+
+// Users
+
+const userColumns = `username, first_name, last_name, email, dob, ongoing_level, multiplayer_score,
+	password_hash, streak_latest_played, streak_latest_start, profile_image_format, profile_image_path,
+	role, email_verified, failed_login_attempts, locked_until, two_factor_enabled, two_factor_secret,
+	two_factor_pending_secret, two_factor_last_used_step, parent_email, consent_requested_at,
+	consent_granted_at, deletion_scheduled_for, token_version, version`
+
+// Column values for userColumns, in the same order
+func userValues(user User) []any {
+	var emailVerified sql.NullBool
+	if user.EmailVerified != nil {
+		emailVerified = sql.NullBool{Bool: *user.EmailVerified, Valid: true}
+	}
+
+	var parentEmail sql.NullString
+	var consentRequestedAt, consentGrantedAt sql.NullTime
+	if user.ParentalConsent != nil {
+		parentEmail = sql.NullString{String: user.ParentalConsent.ParentEmail, Valid: true}
+		consentRequestedAt = dbNullTime(&user.ParentalConsent.RequestedAt)
+		consentGrantedAt = dbNullTime(user.ParentalConsent.GrantedAt)
+	}
+
+	return []any{
+		user.Username, user.FirstName, user.LastName, user.Email, dbTime(user.DOB), user.OngoingLevel, user.MultiPlayerScore,
+		user.PasswordHash, dbTime(user.StreakData.LatestPlayed), dbTime(user.StreakData.LatestStreakStartDate),
+		user.UserProfileImage.Format, user.UserProfileImage.Path,
+		user.Role, emailVerified, user.FailedLoginAttempts, dbTime(user.LockedUntil),
+		user.TwoFactor.Enabled, user.TwoFactor.Secret, user.TwoFactor.PendingSecret, user.TwoFactor.LastUsedStep,
+		parentEmail, consentRequestedAt, consentGrantedAt, dbNullTime(user.DeletionScheduledFor), user.TokenVersion, user.Version,
+	}
+}
+
+// Scan a row of userColumns. Completed levels and recovery codes live in
+// their own tables and are loaded separately.
+func scanUser(row *sql.Rows) (User, error) {
+	var user User
+	var emailVerified sql.NullBool
+	var parentEmail sql.NullString
+	var consentRequestedAt, consentGrantedAt, deletionScheduledFor sql.NullTime
+
+	err := row.Scan(
+		&user.Username, &user.FirstName, &user.LastName, &user.Email, &user.DOB, &user.OngoingLevel, &user.MultiPlayerScore,
+		&user.PasswordHash, &user.StreakData.LatestPlayed, &user.StreakData.LatestStreakStartDate,
+		&user.UserProfileImage.Format, &user.UserProfileImage.Path,
+		&user.Role, &emailVerified, &user.FailedLoginAttempts, &user.LockedUntil,
+		&user.TwoFactor.Enabled, &user.TwoFactor.Secret, &user.TwoFactor.PendingSecret, &user.TwoFactor.LastUsedStep,
+		&parentEmail, &consentRequestedAt, &consentGrantedAt, &deletionScheduledFor, &user.TokenVersion, &user.Version,
+	)
+	if err != nil {
+		return User{}, err
+	}
+
+	if emailVerified.Valid {
+		user.EmailVerified = &emailVerified.Bool
+	}
+	if parentEmail.Valid {
+		user.ParentalConsent = &ParentalConsent{
+			ParentEmail: parentEmail.String,
+			RequestedAt: consentRequestedAt.Time,
+			GrantedAt:   timePointer(consentGrantedAt),
+		}
+	}
+	user.DeletionScheduledFor = timePointer(deletionScheduledFor)
+	return user, nil
+}
+
+// Load the child rows of users that were scanned with scanUser
+func (m *SQLStore) loadUserDetails(ctx context.Context, q sqlQueryer, user *User) error {
+	err := m.eachRow(ctx, q, func(rows *sql.Rows) error {
+		var level CompletedLevel
+		if err := rows.Scan(&level.LevelID, &level.Score); err != nil {
+			return err
+		}
+		user.CompletedLevels = append(user.CompletedLevels, level)
+		return nil
+	}, `SELECT level_id, score FROM completed_levels WHERE username = ? ORDER BY position`, user.Username)
+	if err != nil {
+		return err
+	}
+
+	return m.eachRow(ctx, q, func(rows *sql.Rows) error {
+		var codeHash string
+		if err := rows.Scan(&codeHash); err != nil {
+			return err
+		}
+		user.TwoFactor.RecoveryCodes = append(user.TwoFactor.RecoveryCodes, codeHash)
+		return nil
+	}, `SELECT code_hash FROM recovery_codes WHERE username = ? ORDER BY code_hash`, user.Username)
+}
+
+// Replace the child rows of a user
+func (m *SQLStore) saveUserDetails(ctx context.Context, tx *sql.Tx, user User) error {
+	if _, err := m.exec(ctx, tx, `DELETE FROM completed_levels WHERE username = ?`, user.Username); err != nil {
+		return err
+	}
+	for i, level := range user.CompletedLevels {
+		_, err := m.exec(ctx, tx, `INSERT INTO completed_levels (username, position, level_id, score) VALUES (?, ?, ?, ?)`,
+			user.Username, i, level.LevelID, level.Score)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := m.exec(ctx, tx, `DELETE FROM recovery_codes WHERE username = ?`, user.Username); err != nil {
+		return err
+	}
+	for _, codeHash := range user.TwoFactor.RecoveryCodes {
+		_, err := m.exec(ctx, tx, `INSERT INTO recovery_codes (username, code_hash) VALUES (?, ?)`, user.Username, codeHash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Users matching a WHERE clause, with their child rows
+func (m *SQLStore) findUsers(ctx context.Context, where string, args ...any) ([]User, error) {
+	users := []User{}
+	err := m.eachRow(ctx, m.conn(), func(rows *sql.Rows) error {
+		user, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+		users = append(users, user)
+		return nil
+	}, `SELECT `+userColumns+` FROM users `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Loaded after the rows are closed, since SQLite uses a single connection
+	for i := range users {
+		if err := m.loadUserDetails(ctx, m.conn(), &users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+func (m *SQLStore) findUser(ctx context.Context, where string, args ...any) (User, error) {
+	users, err := m.findUsers(ctx, where+` LIMIT 1`, args...)
+	if err != nil {
+		return User{}, err
+	}
+	if len(users) == 0 {
+		return User{}, ErrNotFound
+	}
+	return users[0], nil
+}
+
+func (m *SQLStore) GetUser(ctx context.Context, username string) (User, error) {
+	return m.findUser(ctx, `WHERE username = ?`, username)
+}
+
+func (m *SQLStore) FindUserByEmail(ctx context.Context, email string) (User, error) {
+	return m.findUser(ctx, `WHERE email = ?`, email)
+}
+
+func (m *SQLStore) ListUsers(ctx context.Context) ([]User, error) {
+	return m.findUsers(ctx, `ORDER BY username`)
+}
+
+func (m *SQLStore) TopUsersByScore(ctx context.Context, limit int) ([]User, error) {
+	return m.findUsers(ctx, `WHERE email_verified IS NOT FALSE AND (parent_email IS NULL OR consent_granted_at IS NOT NULL)
+		ORDER BY multiplayer_score DESC, username LIMIT ?`, limit)
+}
+
+func (m *SQLStore) UsersPendingDeletion(ctx context.Context, before time.Time) ([]User, error) {
+	return m.findUsers(ctx, `WHERE deletion_scheduled_for <= ? ORDER BY deletion_scheduled_for, username`, dbTime(before))
+}
+
+func (m *SQLStore) CreateUser(ctx context.Context, user User) error {
+	err := m.inTx(ctx, func(tx *sql.Tx) error {
+		var exists int
+		err := m.queryRow(ctx, tx, `SELECT COUNT(*) FROM users WHERE username = ?`, user.Username).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return ErrUserExists
+		}
+
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(userValues(user))), ", ")
+		_, err = m.exec(ctx, tx, `INSERT INTO users (`+userColumns+`) VALUES (`+placeholders+`)`, userValues(user)...)
+		if err != nil {
+			return err
+		}
+		return m.saveUserDetails(ctx, tx, user)
+	})
+	if err != nil && err != ErrUserExists {
+		// A concurrent insert of the same username loses on the primary key
+		if _, lookupErr := m.GetUser(ctx, user.Username); lookupErr == nil {
+			return ErrUserExists
+		}
+	}
+	return err
+}
+
+func (m *SQLStore) SaveUser(ctx context.Context, user User) error {
+	saved := user
+	saved.Version++
+	values := userValues(saved)
+	columns := strings.Split(userColumns, ",")
+	assignments := make([]string, 0, len(columns)-1)
+	for _, column := range columns[1:] {
+		assignments = append(assignments, strings.TrimSpace(column)+" = ?")
+	}
+
+	return m.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := m.exec(ctx, tx, `UPDATE users SET `+strings.Join(assignments, ", ")+` WHERE username = ? AND version = ?`,
+			append(values[1:], user.Username, user.Version)...)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return m.missingOrConflict(ctx, tx, "users", "username", user.Username)
+		}
+		return m.saveUserDetails(ctx, tx, user)
+	})
+}
+
+func (m *SQLStore) DeleteUser(ctx context.Context, username string) error {
+	// Child rows go with the user through ON DELETE CASCADE
+	_, err := m.exec(ctx, m.conn(), `DELETE FROM users WHERE username = ?`, username)
+	return err
+}
+
+func (m *SQLStore) IncrementFailedLogins(ctx context.Context, username string) (int, error) {
+	var attempts int
+	err := m.queryRow(ctx, m.conn(),
+		`UPDATE users SET failed_login_attempts = failed_login_attempts + 1, version = version + 1 WHERE username = ? RETURNING failed_login_attempts`,
+		username).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return 0, ErrNotFound
+	}
+	return attempts, err
+}
+
+func (m *SQLStore) AddMultiPlayerScore(ctx context.Context, username string, delta int) error {
+	result, err := m.exec(ctx, m.conn(), `UPDATE users SET multiplayer_score = multiplayer_score + ?, version = version + 1 WHERE username = ?`, delta, username)
+	if err != nil {
+		return err
+	}
+	return requireRowsAffected(result)
+}
+
+func (m *SQLStore) UseTOTPStep(ctx context.Context, username string, step int64) (bool, error) {
+	// Conditional on the stored step so two requests racing with the same
+	// code cannot both succeed
+	result, err := m.exec(ctx, m.conn(),
+		`UPDATE users SET two_factor_last_used_step = ?, version = version + 1 WHERE username = ? AND two_factor_last_used_step < ?`,
+		step, username, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (m *SQLStore) UseRecoveryCode(ctx context.Context, username, codeHash string) (bool, error) {
+	used := false
+	err := m.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := m.exec(ctx, tx, `DELETE FROM recovery_codes WHERE username = ? AND code_hash = ?`, username, codeHash)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil || n == 0 {
+			return err
+		}
+		used = true
+		_, err = m.exec(ctx, tx, `UPDATE users SET version = version + 1 WHERE username = ?`, username)
+		return err
+	})
+	return used && err == nil, err
+}
+
+// Lobbies
+
+// Load the participants, scores and questions of a lobby
+func (m *SQLStore) loadLobbyDetails(ctx context.Context, q sqlQueryer, lobby *Lobby) error {
+	err := m.eachRow(ctx, q, func(rows *sql.Rows) error {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return err
+		}
+		lobby.Participants = append(lobby.Participants, username)
+		return nil
+	}, `SELECT username FROM lobby_participants WHERE lobby_id = ? ORDER BY position`, lobby.ID)
+	if err != nil {
+		return err
+	}
+
+	err = m.eachRow(ctx, q, func(rows *sql.Rows) error {
+		var username string
+		var score int
+		if err := rows.Scan(&username, &score); err != nil {
+			return err
+		}
+		if lobby.Scores == nil {
+			lobby.Scores = make(map[string]int)
+		}
+		lobby.Scores[username] = score
+		return nil
+	}, `SELECT username, score FROM lobby_scores WHERE lobby_id = ?`, lobby.ID)
+	if err != nil {
+		return err
+	}
+
+	return m.eachRow(ctx, q, func(rows *sql.Rows) error {
+		var question Question
+		var options string
+		if err := rows.Scan(&question.ID, &question.QuestionText, &options, &question.CorrectAnswer); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(options), &question.Options); err != nil {
+			return err
+		}
+		lobby.Questions = append(lobby.Questions, question)
+		return nil
+	}, `SELECT question_id, question_text, options, correct_answer FROM lobby_questions WHERE lobby_id = ? ORDER BY position`, lobby.ID)
+}
+
+// Replace the participants, scores and questions of a lobby
+func (m *SQLStore) saveLobbyDetails(ctx context.Context, tx *sql.Tx, lobby Lobby) error {
+	for _, table := range []string{"lobby_participants", "lobby_scores", "lobby_questions"} {
+		if _, err := m.exec(ctx, tx, `DELETE FROM `+table+` WHERE lobby_id = ?`, lobby.ID); err != nil {
+			return err
+		}
+	}
+
+	for i, username := range lobby.Participants {
+		_, err := m.exec(ctx, tx, `INSERT INTO lobby_participants (lobby_id, position, username) VALUES (?, ?, ?)`, lobby.ID, i, username)
+		if err != nil {
+			return err
+		}
+	}
+	for username, score := range lobby.Scores {
+		_, err := m.exec(ctx, tx, `INSERT INTO lobby_scores (lobby_id, username, score) VALUES (?, ?, ?)`, lobby.ID, username, score)
+		if err != nil {
+			return err
+		}
+	}
+	for i, question := range lobby.Questions {
+		options, err := json.Marshal(question.Options)
+		if err != nil {
+			return err
+		}
+		_, err = m.exec(ctx, tx, `INSERT INTO lobby_questions (lobby_id, position, question_id, question_text, options, correct_answer) VALUES (?, ?, ?, ?, ?, ?)`,
+			lobby.ID, i, question.ID, question.QuestionText, string(options), question.CorrectAnswer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *SQLStore) CreateLobby(ctx context.Context, lobby Lobby) error {
+	return m.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := m.exec(ctx, tx, `INSERT INTO lobbies (id, creator, status, created_at, ended_at, progress_at, current_index, version) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			lobby.ID, lobby.Creator, lobby.Status, dbTime(lobby.CreatedAt), dbNullTime(lobby.EndedAt), dbNullTime(lobby.ProgressAt), lobby.CurrentIndex, lobby.Version)
+		if err != nil {
+			return err
+		}
+		return m.saveLobbyDetails(ctx, tx, lobby)
+	})
+}
+
+// Lobbies matching a WHERE clause, oldest first
+func (m *SQLStore) findLobbies(ctx context.Context, where string, args ...any) ([]Lobby, error) {
+	lobbies := []Lobby{}
+	err := m.eachRow(ctx, m.conn(), func(rows *sql.Rows) error {
+		var lobby Lobby
+		var endedAt, progressAt sql.NullTime
+		if err := rows.Scan(&lobby.ID, &lobby.Creator, &lobby.Status, &lobby.CreatedAt, &endedAt, &progressAt, &lobby.CurrentIndex, &lobby.Version); err != nil {
+			return err
+		}
+		lobby.EndedAt = timePointer(endedAt)
+		lobby.ProgressAt = timePointer(progressAt)
+		lobbies = append(lobbies, lobby)
+		return nil
+	}, `SELECT id, creator, status, created_at, ended_at, progress_at, current_index, version FROM lobbies `+where+` ORDER BY created_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range lobbies {
+		if err := m.loadLobbyDetails(ctx, m.conn(), &lobbies[i]); err != nil {
+			return nil, err
+		}
+	}
+	return lobbies, nil
+}
+
+func (m *SQLStore) GetLobby(ctx context.Context, id string) (Lobby, error) {
+	lobbies, err := m.findLobbies(ctx, `WHERE id = ?`, id)
+	if err != nil {
+		return Lobby{}, err
+	}
+	if len(lobbies) == 0 {
+		return Lobby{}, ErrNotFound
+	}
+	return lobbies[0], nil
+}
+
+func (m *SQLStore) ListLobbies(ctx context.Context) ([]Lobby, error) {
+	return m.findLobbies(ctx, ``)
+}
+
+func (m *SQLStore) ListLobbiesByParticipant(ctx context.Context, username string) ([]Lobby, error) {
+	return m.findLobbies(ctx, `WHERE id IN (SELECT lobby_id FROM lobby_participants WHERE username = ?)`, username)
+}
+
+func (m *SQLStore) ListLobbiesByStatus(ctx context.Context, status string) ([]Lobby, error) {
+	return m.findLobbies(ctx, `WHERE status = ?`, status)
+}
+
+func (m *SQLStore) CountLobbiesByStatus(ctx context.Context) (map[string]int, error) {
+	counts := make(map[string]int)
+	err := m.eachRow(ctx, m.conn(), func(rows *sql.Rows) error {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return err
+		}
+		counts[status] = count
+		return nil
+	}, `SELECT status, COUNT(*) FROM lobbies GROUP BY status`)
+	return counts, err
+}
+
+func (m *SQLStore) SaveLobby(ctx context.Context, lobby Lobby) error {
+	return m.inTx(ctx, func(tx *sql.Tx) error {
+		result, err := m.exec(ctx, tx, `UPDATE lobbies SET creator = ?, status = ?, created_at = ?, ended_at = ?, progress_at = ?, current_index = ?, version = ? WHERE id = ? AND version = ?`,
+			lobby.Creator, lobby.Status, dbTime(lobby.CreatedAt), dbNullTime(lobby.EndedAt), dbNullTime(lobby.ProgressAt), lobby.CurrentIndex, lobby.Version+1, lobby.ID, lobby.Version)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return m.missingOrConflict(ctx, tx, "lobbies", "id", lobby.ID)
+		}
+		return m.saveLobbyDetails(ctx, tx, lobby)
+	})
+}
+
+func (m *SQLStore) JoinLobby(ctx context.Context, id, username string, capacity int) (Lobby, error) {
+	err := m.inTx(ctx, func(tx *sql.Tx) error {
+		// Inserts nothing unless every condition holds. Two concurrent joins
+		// compute the same position, so the primary key rejects the second.
+		result, err := m.exec(ctx, tx, `INSERT INTO lobby_participants (lobby_id, position, username)
+			SELECT l.id, (SELECT COUNT(*) FROM lobby_participants p WHERE p.lobby_id = l.id), ?
+			FROM lobbies l
+			WHERE l.id = ? AND l.status = 'waiting'
+				AND (SELECT COUNT(*) FROM lobby_participants p WHERE p.lobby_id = l.id) < ?
+				AND NOT EXISTS (SELECT 1 FROM lobby_participants p WHERE p.lobby_id = l.id AND p.username = ?)`,
+			username, id, capacity, username)
+		if err != nil {
+			return err
+		}
+		if err := requireRowsAffected(result); err != nil {
+			return err
+		}
+		full := `(SELECT COUNT(*) FROM lobby_participants p WHERE p.lobby_id = lobbies.id) >= ?`
+		_, err = m.exec(ctx, tx, `UPDATE lobbies SET version = version + 1,
+				status = CASE WHEN `+full+` THEN 'active' ELSE status END,
+				progress_at = CASE WHEN `+full+` THEN ? ELSE progress_at END
+			WHERE id = ?`, capacity, capacity, dbTime(time.Now()), id)
+		return err
+	})
+
+	if err == nil {
+		return m.GetLobby(ctx, id)
+	}
+
+	// Nothing was inserted, or a concurrent join took the position: find out why
+	current, lookupErr := m.GetLobby(ctx, id)
+	if lookupErr != nil {
+		return Lobby{}, lookupErr
+	}
+	if current.Status != "waiting" || len(current.Participants) >= capacity || slices.Contains(current.Participants, username) {
+		return Lobby{}, joinRefusal(current, username)
+	}
+	if err == ErrNotFound {
+		return Lobby{}, ErrConflict
+	}
+	return Lobby{}, err
+}
+
+// Participants, scores and questions go with the lobby through ON DELETE CASCADE
+func (m *SQLStore) DeleteWaitingLobbies(ctx context.Context, createdBefore time.Time, capacity int) (int, error) {
+	result, err := m.exec(ctx, m.conn(), `DELETE FROM lobbies WHERE status = 'waiting' AND created_at < ?
+		AND (SELECT COUNT(*) FROM lobby_participants p WHERE p.lobby_id = lobbies.id) < ?`, dbTime(createdBefore), capacity)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+func (m *SQLStore) ArchiveEndedLobbies(ctx context.Context, endedBefore time.Time) (int, error) {
+	result, err := m.exec(ctx, m.conn(), `UPDATE lobbies SET status = 'archived', version = version + 1 WHERE status = 'ended' AND ended_at < ?`, dbTime(endedBefore))
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+func (m *SQLStore) EndStaleLobbies(ctx context.Context, progressBefore time.Time) (int, error) {
+	result, err := m.exec(ctx, m.conn(), `UPDATE lobbies SET status = 'ended', ended_at = ?, version = version + 1 WHERE status = 'active' AND progress_at < ?`,
+		dbTime(time.Now()), dbTime(progressBefore))
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// Tokens
+
+func (m *SQLStore) CreateToken(ctx context.Context, token OneTimeToken) error {
+	return m.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := m.exec(ctx, tx, `UPDATE tokens SET used_at = ? WHERE purpose = ? AND username = ? AND used_at IS NULL`,
+			dbTime(token.CreatedAt), token.Purpose, token.Username)
+		if err != nil {
+			return err
+		}
+
+		_, err = m.exec(ctx, tx, `INSERT INTO tokens (token_hash, purpose, username, created_at, expires_at, used_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			token.TokenHash, token.Purpose, token.Username, dbTime(token.CreatedAt), dbTime(token.ExpiresAt), dbNullTime(token.UsedAt))
+		return err
+	})
+}
+
+func (m *SQLStore) ConsumeToken(ctx context.Context, purpose, tokenHash string, now time.Time) (OneTimeToken, error) {
+	var token OneTimeToken
+	var usedAt sql.NullTime
+	err := m.queryRow(ctx, m.conn(),
+		`UPDATE tokens SET used_at = ?
+		WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+		RETURNING token_hash, purpose, username, created_at, expires_at, used_at`,
+		dbTime(now), tokenHash, purpose, dbTime(now),
+	).Scan(&token.TokenHash, &token.Purpose, &token.Username, &token.CreatedAt, &token.ExpiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return OneTimeToken{}, ErrNotFound
+	}
+	if err != nil {
+		return OneTimeToken{}, err
+	}
+	token.UsedAt = timePointer(usedAt)
+	return token, nil
+}
+
+func (m *SQLStore) DeleteUserTokens(ctx context.Context, username string) error {
+	_, err := m.exec(ctx, m.conn(), `DELETE FROM tokens WHERE username = ?`, username)
+	return err
+}
+
+// Audit log
+
+func (m *SQLStore) AppendAuditEvent(ctx context.Context, event AuditEvent) error {
+	var details sql.NullString
+	if len(event.Details) > 0 {
+		encoded, err := json.Marshal(event.Details)
+		if err != nil {
+			return err
+		}
+		details = sql.NullString{String: string(encoded), Valid: true}
+	}
+
+	_, err := m.exec(ctx, m.conn(), `INSERT INTO audit_events (actor, action, target, ip, user_agent, created_at, details) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		event.Actor, event.Action, event.Target, event.IP, event.UserAgent, dbTime(event.Timestamp), details)
+	return err
+}
+
+func (m *SQLStore) QueryAuditEvents(ctx context.Context, query AuditQuery) ([]AuditEvent, error) {
+	var conditions []string
+	var args []any
+	if query.User != "" {
+		conditions = append(conditions, `(actor = ? OR target = ?)`)
+		args = append(args, query.User, query.User)
+	}
+	if query.Action != "" {
+		conditions = append(conditions, `action = ?`)
+		args = append(args, query.Action)
+	}
+	if !query.From.IsZero() {
+		conditions = append(conditions, `created_at >= ?`)
+		args = append(args, dbTime(query.From))
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, `created_at <= ?`)
+		args = append(args, dbTime(query.To))
+	}
+
+	statement := `SELECT actor, action, target, ip, user_agent, created_at, details FROM audit_events`
+	if len(conditions) > 0 {
+		statement += ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+	statement += ` ORDER BY created_at DESC`
+	if query.Limit > 0 {
+		statement += ` LIMIT ?`
+		args = append(args, query.Limit)
+	}
+
+	events := []AuditEvent{}
+	err := m.eachRow(ctx, m.conn(), func(rows *sql.Rows) error {
+		var event AuditEvent
+		var details sql.NullString
+		if err := rows.Scan(&event.Actor, &event.Action, &event.Target, &event.IP, &event.UserAgent, &event.Timestamp, &details); err != nil {
+			return err
+		}
+		if details.Valid {
+			if err := json.Unmarshal([]byte(details.String), &event.Details); err != nil {
+				return err
+			}
+		}
+		events = append(events, event)
+		return nil
+	}, statement, args...)
+	return events, err
+}
+
+func (m *SQLStore) PseudonymizeAuditEvents(ctx context.Context, username, placeholder string) error {
+	return m.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := m.exec(ctx, tx, `UPDATE audit_events SET actor = ? WHERE actor = ?`, placeholder, username); err != nil {
+			return err
+		}
+		_, err := m.exec(ctx, tx, `UPDATE audit_events SET target = ? WHERE target = ?`, placeholder, username)
+		return err
+	})
+}
+
+// Parental consent records
+
+func (m *SQLStore) AddConsentRecord(ctx context.Context, record ConsentRecord) error {
+	_, err := m.exec(ctx, m.conn(), `INSERT INTO consent_records (username, parent_email, dob, granted_at, ip, user_agent) VALUES (?, ?, ?, ?, ?, ?)`,
+		record.Username, record.ParentEmail, dbTime(record.DOB), dbTime(record.GrantedAt), record.IP, record.UserAgent)
+	return err
+}
+
+func (m *SQLStore) ListConsentRecords(ctx context.Context, username string) ([]ConsentRecord, error) {
+	where, args := ``, []any{}
+	if username != "" {
+		where, args = `WHERE username = ? `, []any{username}
+	}
+
+	records := []ConsentRecord{}
+	err := m.eachRow(ctx, m.conn(), func(rows *sql.Rows) error {
+		var record ConsentRecord
+		if err := rows.Scan(&record.Username, &record.ParentEmail, &record.DOB, &record.GrantedAt, &record.IP, &record.UserAgent); err != nil {
+			return err
+		}
+		records = append(records, record)
+		return nil
+	}, `SELECT username, parent_email, dob, granted_at, ip, user_agent FROM consent_records `+where+`ORDER BY granted_at`, args...)
+	return records, err
+}
+
+func (m *SQLStore) PseudonymizeConsentRecords(ctx context.Context, username, placeholder string) error {
+	_, err := m.exec(ctx, m.conn(), `UPDATE consent_records SET username = ? WHERE username = ?`, placeholder, username)
+	return err
+}
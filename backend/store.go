@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Errors returned by every store implementation
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrUserExists = errors.New("username already exists")
+	// A save lost to a concurrent update; reload and try again
+	ErrConflict = errors.New("modified concurrently")
+	// Returned by JoinLobby
+	ErrLobbyUnavailable = errors.New("lobby is either full or not active")
+	ErrAlreadyInLobby   = errors.New("already in the lobby")
+)
+
+// Persistence for user accounts
+type UserStore interface {
+	GetUser(ctx context.Context, username string) (User, error)
+	FindUserByEmail(ctx context.Context, email string) (User, error)
+	ListUsers(ctx context.Context) ([]User, error)
+	// The users with the highest multiplayer scores, at most limit of them,
+	// ties broken by username. Restricted accounts, with an unverified email
+	// or awaiting parental consent, are left out, since the leaderboard is
+	// public.
+	TopUsersByScore(ctx context.Context, limit int) ([]User, error)
+	// Users whose account deletion was scheduled for the given time or
+	// earlier, soonest first
+	UsersPendingDeletion(ctx context.Context, before time.Time) ([]User, error)
+	// Fails with ErrUserExists if the username is taken
+	CreateUser(ctx context.Context, user User) error
+	// Replace the stored user with the same username if its version still
+	// equals user.Version, and increment the version. Fails with ErrConflict if
+	// the user was changed since it was read.
+	SaveUser(ctx context.Context, user User) error
+	DeleteUser(ctx context.Context, username string) error
+
+	// Atomic updates that also increment the version, so a concurrent SaveUser
+	// of an older copy fails instead of undoing them
+
+	// Add one to the failed login counter and return the new count
+	IncrementFailedLogins(ctx context.Context, username string) (int, error)
+	AddMultiPlayerScore(ctx context.Context, username string, delta int) error
+	// Record a TOTP time step as used; false if it (or a later one) already was
+	UseTOTPStep(ctx context.Context, username string, step int64) (bool, error)
+	// Remove a recovery code hash; false if the user did not have it
+	UseRecoveryCode(ctx context.Context, username, codeHash string) (bool, error)
+}
+
+// Persistence for multiplayer lobbies
+type LobbyStore interface {
+	CreateLobby(ctx context.Context, lobby Lobby) error
+	GetLobby(ctx context.Context, id string) (Lobby, error)
+	ListLobbies(ctx context.Context) ([]Lobby, error)
+	ListLobbiesByParticipant(ctx context.Context, username string) ([]Lobby, error)
+	ListLobbiesByStatus(ctx context.Context, status string) ([]Lobby, error)
+	// Number of lobbies in each status; statuses without lobbies are left out
+	CountLobbiesByStatus(ctx context.Context) (map[string]int, error)
+	// Replace the stored lobby with the same ID if its version still equals
+	// lobby.Version, and increment the version. Fails with ErrConflict if the
+	// lobby was changed since it was read.
+	SaveLobby(ctx context.Context, lobby Lobby) error
+	// Add a participant in one conditional update, only while the lobby is
+	// waiting, has fewer than capacity participants and does not already
+	// include the user. The join that fills the lobby also moves it to
+	// "active" in the same update. Returns the lobby after the join, or
+	// ErrNotFound, ErrAlreadyInLobby or ErrLobbyUnavailable.
+	JoinLobby(ctx context.Context, id, username string, capacity int) (Lobby, error)
+	// Delete lobbies still waiting with fewer than capacity participants that
+	// were created before the cutoff, returning how many were removed
+	DeleteWaitingLobbies(ctx context.Context, createdBefore time.Time, capacity int) (int, error)
+	// Move lobbies that ended before the cutoff to the archived status,
+	// incrementing their versions, and return how many were archived
+	ArchiveEndedLobbies(ctx context.Context, endedBefore time.Time) (int, error)
+	// End active lobbies whose game last progressed before the cutoff, e.g.
+	// after a crash nobody resumed it from, incrementing their versions, and
+	// return how many were ended. Their scores are not credited, since the
+	// game never finished.
+	EndStaleLobbies(ctx context.Context, progressBefore time.Time) (int, error)
+}
+
+// Explain a join that was refused, from the lobby as it is now
+func joinRefusal(lobby Lobby, username string) error {
+	if slices.Contains(lobby.Participants, username) {
+		return ErrAlreadyInLobby
+	}
+	return ErrLobbyUnavailable
+}
+
+// Persistence for single-use tokens
+type TokenStore interface {
+	// Store a token, invalidating earlier unused tokens for the same user and purpose
+	CreateToken(ctx context.Context, token OneTimeToken) error
+	// Mark an unexpired, unused token as used and return it, or ErrNotFound
+	ConsumeToken(ctx context.Context, purpose, tokenHash string, now time.Time) (OneTimeToken, error)
+	DeleteUserTokens(ctx context.Context, username string) error
+}
+
+// Filters for reading the audit log. Zero values mean "no filter".
+type AuditQuery struct {
+	User   string // actor or target
+	Action string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// Append-only persistence for audit events. The one change made to stored
+// events is pseudonymizing a purged user.
+type AuditStore interface {
+	AppendAuditEvent(ctx context.Context, event AuditEvent) error
+	// Matching events, newest first
+	QueryAuditEvents(ctx context.Context, query AuditQuery) ([]AuditEvent, error)
+	// Replace a username wherever it is the actor or target of an event
+	PseudonymizeAuditEvents(ctx context.Context, username, placeholder string) error
+}
+
+// Persistence for parental consent records
+type ConsentStore interface {
+	AddConsentRecord(ctx context.Context, record ConsentRecord) error
+	// Records for a user, or every record when username is empty
+	ListConsentRecords(ctx context.Context, username string) ([]ConsentRecord, error)
+	// Replace the username of a user's records
+	PseudonymizeConsentRecords(ctx context.Context, username, placeholder string) error
+}
+
+// A complete storage backend
+type Store interface {
+	UserStore
+	LobbyStore
+	TokenStore
+	AuditStore
+	ConsentStore
+	// Check that the database answers and every known migration has been
+	// applied, for the readiness probe
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// Returned by Ping when the database schema is older than this build expects
+func errSchemaBehind(applied, known int) error {
+	return fmt.Errorf("%d of %d schema migrations applied", applied, known)
+}
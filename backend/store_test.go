@@ -0,0 +1,742 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A store implementation the conformance tests run against. PostgreSQL and
+// MongoDB are only tested when TEST_DATABASE_URL (a postgres:// URL) or
+// TEST_MONGO_URI points at a server; each test gets its own schema or
+// database there, dropped when it finishes.
+type storeBackend struct {
+	name string
+	// Prepare an empty database for a test and return where it is
+	database func(t *testing.T) string
+	// Open the store on a database; nil for stores that keep nothing
+	connect func(location string) (Store, error)
+}
+
+func storeBackends() []storeBackend {
+	backends := []storeBackend{
+		{
+			name:     "memory",
+			database: func(t *testing.T) string { return "" },
+		},
+		{
+			name: "sqlite",
+			database: func(t *testing.T) string {
+				return filepath.Join(t.TempDir(), "store.db")
+			},
+			connect: func(location string) (Store, error) {
+				return NewSQLStore("sqlite", location)
+			},
+		},
+	}
+
+	if databaseURL := os.Getenv("TEST_DATABASE_URL"); databaseURL != "" {
+		backends = append(backends, storeBackend{
+			name:     "postgres",
+			database: func(t *testing.T) string { return postgresTestSchema(t, databaseURL) },
+			connect: func(location string) (Store, error) {
+				return NewSQLStore("postgres", location)
+			},
+		})
+	}
+	if mongoURI := os.Getenv("TEST_MONGO_URI"); mongoURI != "" {
+		backends = append(backends, storeBackend{
+			name:     "mongo",
+			database: func(t *testing.T) string { return mongoTestDatabase(t, mongoURI) },
+			connect: func(location string) (Store, error) {
+				return NewMongoStore(mongoURI, location)
+			},
+		})
+	}
+	return backends
+}
+
+func testName(prefix string) string {
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	return prefix + hex.EncodeToString(suffix)
+}
+
+// Create a schema for one test and return a URL whose connections use it
+func postgresTestSchema(t *testing.T, databaseURL string) string {
+	t.Helper()
+	db, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	schema := testName("conformance_")
+	if _, err := db.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+	})
+
+	location, err := url.Parse(databaseURL)
+	if err != nil {
+		t.Fatalf("TEST_DATABASE_URL is not a URL: %v", err)
+	}
+	query := location.Query()
+	query.Set("search_path", schema)
+	location.RawQuery = query.Encode()
+	return location.String()
+}
+
+// Pick a database name for one test and drop the database afterwards
+func mongoTestDatabase(t *testing.T, mongoURI string) string {
+	t.Helper()
+	database := testName("conformance_")
+	t.Cleanup(func() {
+		ctx := context.Background()
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+		if err != nil {
+			t.Errorf("dropping database %s: %v", database, err)
+			return
+		}
+		defer client.Disconnect(ctx)
+		if err := client.Database(database).Drop(ctx); err != nil {
+			t.Errorf("dropping database %s: %v", database, err)
+		}
+	})
+	return database
+}
+
+func (b storeBackend) open(t *testing.T, location string) Store {
+	t.Helper()
+	if b.connect == nil {
+		return NewMemoryStore()
+	}
+	store, err := b.connect(location)
+	if err != nil {
+		t.Fatalf("opening %s store: %v", b.name, err)
+	}
+	t.Cleanup(func() { store.Close(context.Background()) })
+	return store
+}
+
+var storeTests = []struct {
+	name string
+	run  func(t *testing.T, store Store)
+}{
+	{"Users", testStoreUsers},
+	{"UserVersions", testStoreUserVersions},
+	{"UpdateUser", testStoreUpdateUser},
+	{"TopUsersByScore", testStoreTopUsersByScore},
+	{"UsersPendingDeletion", testStoreUsersPendingDeletion},
+	{"JoinLobby", testStoreJoinLobby},
+	{"LobbyVersions", testStoreLobbyVersions},
+	{"UnversionedLobby", testStoreUnversionedLobby},
+	{"LobbyCleanup", testStoreLobbyCleanup},
+	{"ConsumeToken", testStoreConsumeToken},
+}
+
+// Every store must behave the same to the handlers
+func TestStoreConformance(t *testing.T) {
+	for _, backend := range storeBackends() {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, test := range storeTests {
+				t.Run(test.name, func(t *testing.T) {
+					test.run(t, backend.open(t, backend.database(t)))
+				})
+			}
+		})
+	}
+}
+
+// Opening a store on a database that is already up to date applies nothing
+// and keeps the data
+func TestMigrationsAreIdempotent(t *testing.T) {
+	ctx := context.Background()
+	for _, backend := range storeBackends() {
+		if backend.connect == nil {
+			continue
+		}
+		t.Run(backend.name, func(t *testing.T) {
+			location := backend.database(t)
+			first := backend.open(t, location)
+			if err := first.CreateUser(ctx, testUser("alice")); err != nil {
+				t.Fatal(err)
+			}
+			first.Close(ctx)
+
+			second := backend.open(t, location)
+			if err := second.Ping(ctx); err != nil {
+				t.Fatalf("ping after reopening: %v", err)
+			}
+			if _, err := second.GetUser(ctx, "alice"); err != nil {
+				t.Fatalf("user after reopening: %v", err)
+			}
+		})
+	}
+}
+
+func testUser(username string) User {
+	return User{
+		Username: username,
+		Email:    username + "@example.com",
+		DOB:      time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		Role:     RoleStudent,
+	}
+}
+
+func testLobby(id, creator string) Lobby {
+	return Lobby{
+		ID:           id,
+		Creator:      creator,
+		Questions:    []Question{{QuestionText: "2 + 2", Options: []string{"3", "4"}, CorrectAnswer: "4"}},
+		Participants: []string{creator},
+		Status:       "waiting",
+		CreatedAt:    time.Now().UTC().Truncate(time.Second),
+		Scores:       map[string]int{},
+	}
+}
+
+func expectErr(t *testing.T, err, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Fatalf("error %v, want %v", err, want)
+	}
+}
+
+func testStoreUsers(t *testing.T, store Store) {
+	ctx := context.Background()
+	if err := store.CreateUser(ctx, testUser("alice")); err != nil {
+		t.Fatal(err)
+	}
+	duplicate := testUser("alice")
+	duplicate.Email = "other@example.com"
+	expectErr(t, store.CreateUser(ctx, duplicate), ErrUserExists)
+
+	user, err := store.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "alice@example.com" {
+		t.Fatalf("duplicate replaced the user: %+v", user)
+	}
+	if _, err := store.FindUserByEmail(ctx, "alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.GetUser(ctx, "nobody")
+	expectErr(t, err, ErrNotFound)
+	expectErr(t, store.SaveUser(ctx, testUser("nobody")), ErrNotFound)
+
+	if err := store.DeleteUser(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.GetUser(ctx, "alice")
+	expectErr(t, err, ErrNotFound)
+}
+
+func testStoreUserVersions(t *testing.T, store Store) {
+	ctx := context.Background()
+	if err := store.CreateUser(ctx, testUser("alice")); err != nil {
+		t.Fatal(err)
+	}
+	read, err := store.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := read
+	saved.FirstName = "Alice"
+	if err := store.SaveUser(ctx, saved); err != nil {
+		t.Fatal(err)
+	}
+	// The copy read before the save is now stale
+	stale := read
+	stale.LastName = "Smith"
+	expectErr(t, store.SaveUser(ctx, stale), ErrConflict)
+
+	current, err := store.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Version != read.Version+1 || current.FirstName != "Alice" || current.LastName != "" {
+		t.Fatalf("user after a save and a conflict: %+v", current)
+	}
+
+	// Atomic updates increment the version too
+	if err := store.AddMultiPlayerScore(ctx, "alice", 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.IncrementFailedLogins(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	expectErr(t, store.SaveUser(ctx, current), ErrConflict)
+
+	current, err = store.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.MultiPlayerScore != 5 || current.FailedLoginAttempts != 1 || current.Version != read.Version+3 {
+		t.Fatalf("user after atomic updates: %+v", current)
+	}
+}
+
+func testStoreUpdateUser(t *testing.T, store Store) {
+	ctx := context.Background()
+	server := &Server{users: store}
+	if err := store.CreateUser(ctx, testUser("alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A concurrent write during the first attempt makes it start over
+	attempts := 0
+	updated, err := server.updateUser(ctx, "alice", func(user *User) error {
+		attempts++
+		if attempts == 1 {
+			if err := store.AddMultiPlayerScore(ctx, "alice", 10); err != nil {
+				t.Fatal(err)
+			}
+		}
+		user.FirstName = "Alice"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatalf("%d attempts, want 2", attempts)
+	}
+	stored, err := store.GetUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.FirstName != "Alice" || stored.MultiPlayerScore != 10 || stored.Version != updated.Version {
+		t.Fatalf("stored %+v, returned version %d", stored, updated.Version)
+	}
+
+	// Losing every attempt gives up with ErrConflict
+	_, err = server.updateUser(ctx, "alice", func(user *User) error {
+		return store.AddMultiPlayerScore(ctx, "alice", 1)
+	})
+	expectErr(t, err, ErrConflict)
+
+	_, err = server.updateUser(ctx, "nobody", func(user *User) error { return nil })
+	expectErr(t, err, ErrNotFound)
+}
+
+func testStoreTopUsersByScore(t *testing.T, store Store) {
+	ctx := context.Background()
+	scores := map[string]int{"alice": 30, "bob": 50, "carol": 30, "dave": 10, "erin": 90, "frank": 70, "grace": 20}
+	verified, unverified := true, false
+	for username, score := range scores {
+		user := testUser(username)
+		user.MultiPlayerScore = score
+		switch username {
+		case "erin":
+			user.ParentalConsent = &ParentalConsent{ParentEmail: "parent@example.com", RequestedAt: time.Now().UTC().Truncate(time.Second)}
+		case "frank":
+			user.EmailVerified = &unverified
+		case "grace":
+			user.EmailVerified = &verified
+		}
+		if err := store.CreateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// erin is awaiting consent, frank's email is unverified, and alice ties
+	// with carol
+	top, err := store.TopUsersByScore(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var usernames []string
+	for _, user := range top {
+		usernames = append(usernames, user.Username)
+	}
+	if want := []string{"bob", "alice", "carol"}; !slices.Equal(usernames, want) {
+		t.Fatalf("top users %v, want %v", usernames, want)
+	}
+
+	all, err := store.TopUsersByScore(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 5 {
+		t.Fatalf("%d users on the leaderboard, want 5", len(all))
+	}
+}
+
+func testStoreUsersPendingDeletion(t *testing.T, store Store) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	scheduled := map[string]time.Time{
+		"alice": now.Add(-time.Hour),
+		"bob":   now.Add(-48 * time.Hour),
+		"carol": now,
+		"dave":  now.Add(time.Hour),
+	}
+	for _, username := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		user := testUser(username)
+		if scheduledFor, ok := scheduled[username]; ok {
+			user.DeletionScheduledFor = &scheduledFor
+		}
+		if err := store.CreateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// dave is not due yet and erin never asked for deletion
+	due, err := store.UsersPendingDeletion(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var usernames []string
+	for _, user := range due {
+		usernames = append(usernames, user.Username)
+	}
+	if want := []string{"bob", "alice", "carol"}; !slices.Equal(usernames, want) {
+		t.Fatalf("users pending deletion %v, want %v", usernames, want)
+	}
+}
+
+func testStoreJoinLobby(t *testing.T, store Store) {
+	ctx := context.Background()
+	const capacity = 3
+	if err := store.CreateLobby(ctx, testLobby("lobby-1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	lobby, err := store.JoinLobby(ctx, "lobby-1", "bob", capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lobby.Status != "waiting" || !slices.Equal(lobby.Participants, []string{"alice", "bob"}) {
+		t.Fatalf("lobby after the first join: %+v", lobby)
+	}
+	_, err = store.JoinLobby(ctx, "lobby-1", "bob", capacity)
+	expectErr(t, err, ErrAlreadyInLobby)
+
+	// The join that fills the lobby starts the game
+	lobby, err = store.JoinLobby(ctx, "lobby-1", "carol", capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lobby.Status != "active" || len(lobby.Participants) != capacity || lobby.ProgressAt == nil {
+		t.Fatalf("lobby after filling up: %+v", lobby)
+	}
+	stored, err := store.GetLobby(ctx, "lobby-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != "active" || !slices.Equal(stored.Participants, []string{"alice", "bob", "carol"}) {
+		t.Fatalf("stored lobby after filling up: %+v", stored)
+	}
+
+	_, err = store.JoinLobby(ctx, "lobby-1", "dave", capacity)
+	expectErr(t, err, ErrLobbyUnavailable)
+	_, err = store.JoinLobby(ctx, "lobby-1", "alice", capacity)
+	expectErr(t, err, ErrAlreadyInLobby)
+	_, err = store.JoinLobby(ctx, "missing", "dave", capacity)
+	expectErr(t, err, ErrNotFound)
+
+	// A lobby that is no longer waiting takes nobody, full or not
+	ended := testLobby("lobby-2", "alice")
+	ended.Status = "ended"
+	if err := store.CreateLobby(ctx, ended); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.JoinLobby(ctx, "lobby-2", "bob", capacity)
+	expectErr(t, err, ErrLobbyUnavailable)
+
+	joined, err := store.ListLobbiesByParticipant(ctx, "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(joined) != 1 || joined[0].ID != "lobby-1" {
+		t.Fatalf("carol's lobbies: %+v", joined)
+	}
+}
+
+func testStoreLobbyVersions(t *testing.T, store Store) {
+	ctx := context.Background()
+	if err := store.CreateLobby(ctx, testLobby("lobby-1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	read, err := store.GetLobby(ctx, "lobby-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A join is a write like any other
+	if _, err := store.JoinLobby(ctx, "lobby-1", "bob", 3); err != nil {
+		t.Fatal(err)
+	}
+	stale := read
+	stale.Status = "ended"
+	expectErr(t, store.SaveLobby(ctx, stale), ErrConflict)
+
+	current, err := store.GetLobby(ctx, "lobby-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.Scores = map[string]int{"alice": 10}
+	current.CurrentIndex = 1
+	if err := store.SaveLobby(ctx, current); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.GetLobby(ctx, "lobby-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Version != current.Version+1 || saved.Scores["alice"] != 10 || saved.CurrentIndex != 1 || saved.Status != "waiting" {
+		t.Fatalf("lobby after saving: %+v", saved)
+	}
+	expectErr(t, store.SaveLobby(ctx, testLobby("missing", "alice")), ErrNotFound)
+}
+
+// Store a lobby as it was written before versioning. Only MongoDB documents
+// can lack a version; the other stores have always had one.
+func createUnversionedLobby(t *testing.T, store Store, lobby Lobby) {
+	t.Helper()
+	ctx := context.Background()
+	if err := store.CreateLobby(ctx, lobby); err != nil {
+		t.Fatal(err)
+	}
+	if mongoStore, ok := store.(*MongoStore); ok {
+		_, err := mongoStore.lobbies.UpdateOne(ctx, bson.M{"_id": lobby.ID}, bson.M{"$unset": bson.M{"version": ""}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testStoreUnversionedLobby(t *testing.T, store Store) {
+	ctx := context.Background()
+	createUnversionedLobby(t, store, testLobby("lobby-1", "alice"))
+	read, err := store.GetLobby(ctx, "lobby-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Version != 0 {
+		t.Fatalf("unversioned lobby read at version %d, want 0", read.Version)
+	}
+
+	// The join versions the lobby, so the copy read before it is stale
+	joined, err := store.JoinLobby(ctx, "lobby-1", "bob", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined.Version != 1 {
+		t.Fatalf("lobby version %d after joining, want 1", joined.Version)
+	}
+	stale := read
+	stale.Status = "ended"
+	expectErr(t, store.SaveLobby(ctx, stale), ErrConflict)
+
+	current, err := store.GetLobby(ctx, "lobby-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Status != "waiting" || !slices.Equal(current.Participants, []string{"alice", "bob"}) {
+		t.Fatalf("the join was overwritten: %+v", current)
+	}
+}
+
+func testStoreLobbyCleanup(t *testing.T, store Store) {
+	ctx := context.Background()
+	const capacity = 2
+	now := time.Now().UTC().Truncate(time.Second)
+	old, recent, cutoff := now.Add(-2*time.Hour), now, now.Add(-time.Hour)
+
+	lobby := func(id, status string, createdAt time.Time, participants ...string) Lobby {
+		lobby := testLobby(id, "alice")
+		lobby.Status = status
+		lobby.CreatedAt = createdAt
+		lobby.Participants = append(lobby.Participants, participants...)
+		return lobby
+	}
+	ended := func(id string, endedAt time.Time) Lobby {
+		lobby := lobby(id, "ended", old, "bob")
+		lobby.EndedAt = &endedAt
+		return lobby
+	}
+	active := func(id string, progressAt time.Time) Lobby {
+		lobby := lobby(id, "active", old, "bob")
+		lobby.ProgressAt = &progressAt
+		return lobby
+	}
+	for _, lobby := range []Lobby{
+		lobby("abandoned", "waiting", old),
+		lobby("new", "waiting", recent),
+		lobby("full", "waiting", old, "bob"),
+		active("playing", recent),
+		active("stalled", old),
+		ended("finished-long-ago", old),
+		ended("finished-just-now", recent),
+	} {
+		if err := store.CreateLobby(ctx, lobby); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts, err := store.CountLobbiesByStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["waiting"] != 3 || counts["active"] != 2 || counts["ended"] != 2 || len(counts) != 3 {
+		t.Fatalf("counts before cleanup: %v", counts)
+	}
+
+	deleted, err := store.DeleteWaitingLobbies(ctx, cutoff, capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 1 {
+		t.Fatalf("deleted %d waiting lobbies, want 1", deleted)
+	}
+	_, err = store.GetLobby(ctx, "abandoned")
+	expectErr(t, err, ErrNotFound)
+
+	stalled, err := store.GetLobby(ctx, "stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	abandoned, err := store.EndStaleLobbies(ctx, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if abandoned != 1 {
+		t.Fatalf("ended %d stale lobbies, want 1", abandoned)
+	}
+	stalledAfter, err := store.GetLobby(ctx, "stalled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stalledAfter.Status != "ended" || stalledAfter.EndedAt == nil || stalledAfter.EndedAt.Before(recent) || stalledAfter.Version != stalled.Version+1 {
+		t.Fatalf("stale lobby after ending %+v, version before %d", stalledAfter, stalled.Version)
+	}
+
+	before, err := store.GetLobby(ctx, "finished-long-ago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived, err := store.ArchiveEndedLobbies(ctx, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archived != 1 {
+		t.Fatalf("archived %d lobbies, want 1", archived)
+	}
+	after, err := store.GetLobby(ctx, "finished-long-ago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Status != "archived" || after.Version != before.Version+1 {
+		t.Fatalf("archived lobby %+v, version before %d", after, before.Version)
+	}
+
+	counts, err = store.CountLobbiesByStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stale game ended just now, so it is not archived yet
+	want := map[string]int{"waiting": 2, "active": 1, "ended": 2, "archived": 1}
+	if len(counts) != len(want) {
+		t.Fatalf("counts after cleanup %v, want %v", counts, want)
+	}
+	for status, count := range want {
+		if counts[status] != count {
+			t.Fatalf("counts after cleanup %v, want %v", counts, want)
+		}
+	}
+}
+
+func testStoreConsumeToken(t *testing.T, store Store) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	token := func(hash, purpose string, expiresAt time.Time) OneTimeToken {
+		return OneTimeToken{TokenHash: hash, Purpose: purpose, Username: "alice", CreatedAt: now, ExpiresAt: expiresAt}
+	}
+	for _, created := range []OneTimeToken{
+		token("reset", passwordResetPurpose, now.Add(time.Hour)),
+		token("expired", emailVerificationPurpose, now.Add(-time.Minute)),
+	} {
+		if err := store.CreateToken(ctx, created); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := store.ConsumeToken(ctx, emailVerificationPurpose, "reset", now)
+	expectErr(t, err, ErrNotFound)
+	consumed, err := store.ConsumeToken(ctx, passwordResetPurpose, "reset", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consumed.Username != "alice" || consumed.UsedAt == nil {
+		t.Fatalf("consumed token %+v", consumed)
+	}
+	// Single use
+	_, err = store.ConsumeToken(ctx, passwordResetPurpose, "reset", now)
+	expectErr(t, err, ErrNotFound)
+
+	_, err = store.ConsumeToken(ctx, emailVerificationPurpose, "expired", now)
+	expectErr(t, err, ErrNotFound)
+	_, err = store.ConsumeToken(ctx, passwordResetPurpose, "missing", now)
+	expectErr(t, err, ErrNotFound)
+
+	// A new token for the same purpose replaces the unused one
+	if err := store.CreateToken(ctx, token("first", passwordResetPurpose, now.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateToken(ctx, token("second", passwordResetPurpose, now.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.ConsumeToken(ctx, passwordResetPurpose, "first", now)
+	expectErr(t, err, ErrNotFound)
+	if _, err := store.ConsumeToken(ctx, passwordResetPurpose, "second", now); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLiteDSN(t *testing.T) {
+	const options = "_pragma=foreign_keys%281%29&_pragma=busy_timeout%285000%29&_time_format=sqlite"
+	tests := []struct {
+		dsn, want string
+	}{
+		{"samvidha.db", "file:samvidha.db?" + options},
+		{"/var/lib/samvidha/data.db", "file:/var/lib/samvidha/data.db?" + options},
+		{"file:data.db?mode=rwc", "file:data.db?" + options + "&mode=rwc"},
+		// Pragmas already given are not repeated, but the time format is forced
+		{"file:data.db?_pragma=foreign_keys(1)&_time_format=datetime", "file:data.db?" + options},
+	}
+	for _, test := range tests {
+		got, err := sqliteDSN(test.dsn)
+		if err != nil {
+			t.Errorf("sqliteDSN(%q): %v", test.dsn, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("sqliteDSN(%q) = %q, want %q", test.dsn, got, test.want)
+		}
+	}
+
+	if _, err := sqliteDSN("file:data.db?mode=%zz"); err == nil {
+		t.Error("sqliteDSN accepted an invalid query")
+	}
+}
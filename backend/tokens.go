@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Token types carried in the "typ" claim so a refresh token can never be
+// used where an access token is expected (and vice versa)
+const (
+	accessTokenType    = "access"
+	refreshTokenType   = "refresh"
+	twoFactorTokenType = "2fa" // proves the password step of a two-factor login
+
+	accessTokenTTL        = 15 * time.Minute
+	refreshTokenTTL       = 7 * 24 * time.Hour
+	twoFactorChallengeTTL = 5 * time.Minute
+)
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+// Claims stored inside a signed token
+type TokenClaims struct {
+	Subject      string `json:"sub"`
+	Type         string `json:"typ"`
+	IssuedAt     int64  `json:"iat"`
+	ExpiresAt    int64  `json:"exp"`
+	TokenVersion int    `json:"ver"` // the user's TokenVersion when issued
+}
+
+// Pair of tokens handed to the client after a successful login
+type TokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"` // access token lifetime in seconds
+}
+
+// HS256 JWT header, encoded once since it never changes
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Sign a token of the given type for a user
+func (s *Server) signToken(user User, tokenType string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := TokenClaims{
+		Subject:      user.Username,
+		Type:         tokenType,
+		IssuedAt:     now.Unix(),
+		ExpiresAt:    now.Add(ttl).Unix(),
+		TokenVersion: user.TokenVersion,
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + s.tokenSignature(unsigned), nil
+}
+
+// Verify a token's signature, type and expiry and return its claims
+func (s *Server) parseToken(token, tokenType string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return nil, errInvalidToken
+	}
+
+	expected := s.tokenSignature(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	var claims TokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+
+	if claims.Type != tokenType || claims.Subject == "" || time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errInvalidToken
+	}
+
+	return &claims, nil
+}
+
+// Parse a token and load its user, failing with errInvalidToken when the
+// user no longer exists or has revoked the token by bumping TokenVersion
+func (s *Server) authenticateToken(ctx context.Context, token, tokenType string) (User, error) {
+	claims, err := s.parseToken(token, tokenType)
+	if err != nil {
+		return User{}, err
+	}
+
+	user, err := s.users.GetUser(ctx, claims.Subject)
+	if err == ErrNotFound {
+		return User{}, errInvalidToken
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if claims.TokenVersion != user.TokenVersion {
+		return User{}, errInvalidToken
+	}
+	return user, nil
+}
+
+// Issue a fresh access/refresh token pair for a user
+func (s *Server) issueTokenPair(user User) (TokenPair, error) {
+	accessToken, err := s.signToken(user, accessTokenType, accessTokenTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refreshToken, err := s.signToken(user, refreshTokenType, refreshTokenTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+func (s *Server) tokenSignature(unsigned string) string {
+	mac := hmac.New(sha256.New, s.tokenSecret)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Answer a change that revoked the user's sessions with a message and a new
+// token pair, so the client that made the change stays signed in
+func (s *Server) writeRenewedSession(w http.ResponseWriter, user User, message string) {
+	tokens, err := s.issueTokenPair(user)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to issue session tokens")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"message": message, "tokens": tokens})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const recoveryCodeCount = 10
+
+// Refusals from the enrollment updates, checked against the stored user
+var (
+	errTwoFactorEnabled      = errors.New("two-factor authentication is already enabled")
+	errNoTwoFactorEnrollment = errors.New("no two-factor enrollment in progress")
+	errInvalidTwoFactorCode  = errors.New("invalid authentication code")
+)
+
+// Send the second-step challenge to a user with two-factor authentication
+func (s *Server) writeTwoFactorChallenge(w http.ResponseWriter, user User) {
+	challengeToken, err := s.signToken(user, twoFactorTokenType, twoFactorChallengeTTL)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to issue challenge token")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"twoFactorRequired": true,
+		"challengeToken":    challengeToken,
+	})
+}
+
+// Second login step: exchange a challenge token and a TOTP or recovery code
+// for a session
+func (s *Server) handleTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		ChallengeToken string `json:"challengeToken"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recoveryCode"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	user, err := s.authenticateToken(r.Context(), requestData.ChallengeToken, twoFactorTokenType)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "Invalid or expired challenge token")
+		return
+	}
+
+	if wait := s.loginLimiter.retryAfter(clientIP(r)); wait > 0 {
+		writeRetryAfter(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later", wait)
+		return
+	}
+
+	if wait := time.Until(user.LockedUntil); wait > 0 {
+		loginsTotal.WithLabelValues("failed").Inc()
+		s.recordAudit(r, "", auditLoginFailed, user.Username, map[string]string{"reason": "locked"})
+		writeRetryAfter(w, http.StatusLocked, "Account is temporarily locked after too many failed login attempts", wait)
+		return
+	}
+
+	ok, err := s.checkSecondFactor(r, user, requestData.Code, requestData.RecoveryCode)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to verify authentication code")
+		return
+	}
+	if !ok {
+		// Wrong codes count towards the same lockout as wrong passwords
+		s.rejectCredentials(w, r, user.Username, "bad_2fa_code", "Invalid authentication code")
+		return
+	}
+
+	s.loginLimiter.forget(clientIP(r))
+	if user.FailedLoginAttempts > 0 {
+		if err := s.resetFailedLogins(r.Context(), user.Username); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to reset failed login counter", "username", user.Username, "error", err)
+		}
+	}
+
+	loginsTotal.WithLabelValues("succeeded").Inc()
+	s.recordAudit(r, user.Username, auditLoginSucceeded, user.Username, map[string]string{"secondFactor": "true"})
+	s.writeLoginResponse(w, user)
+}
+
+// Start enrollment: generate a secret the user adds to an authenticator app.
+// Two-factor authentication is only switched on once a code is confirmed.
+func (s *Server) handleTwoFactorEnroll(w http.ResponseWriter, r *http.Request) {
+	username := authenticatedUsername(r)
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to generate secret")
+		return
+	}
+
+	_, err = s.updateUser(r.Context(), username, func(user *User) error {
+		if user.TwoFactor.Enabled {
+			return errTwoFactorEnabled
+		}
+		user.TwoFactor.PendingSecret = secret
+		return nil
+	})
+	if err == errTwoFactorEnabled {
+		writeError(w, http.StatusConflict, codeConflict, "Two-factor authentication is already enabled")
+		return
+	}
+	if err != nil {
+		writeSaveError(w, err, "Failed to start enrollment")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"secret":     secret,
+		"otpauthUri": totpURI(secret, username),
+	})
+}
+
+// Finish enrollment with a code from the authenticator app. Returns the
+// recovery codes, which are shown to the user exactly once.
+func (s *Server) handleTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Code string `json:"code"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	username := authenticatedUsername(r)
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to generate recovery codes")
+		return
+	}
+
+	user, err := s.updateUser(r.Context(), username, func(user *User) error {
+		if user.TwoFactor.Enabled {
+			return errTwoFactorEnabled
+		}
+		if user.TwoFactor.PendingSecret == "" {
+			return errNoTwoFactorEnrollment
+		}
+		step := verifyTOTP(user.TwoFactor.PendingSecret, requestData.Code, 0, time.Now())
+		if step < 0 {
+			return errInvalidTwoFactorCode
+		}
+
+		// Sessions signed in without the second factor are signed out
+		user.TwoFactor = TwoFactorSettings{
+			Enabled:       true,
+			Secret:        user.TwoFactor.PendingSecret,
+			RecoveryCodes: hashes,
+			LastUsedStep:  step,
+		}
+		user.TokenVersion++
+		return nil
+	})
+	switch err {
+	case nil:
+	case errTwoFactorEnabled:
+		writeError(w, http.StatusConflict, codeConflict, "Two-factor authentication is already enabled")
+		return
+	case errNoTwoFactorEnrollment:
+		writeError(w, http.StatusConflict, codeConflict, "No two-factor enrollment in progress")
+		return
+	case errInvalidTwoFactorCode:
+		writeValidationError(w, FieldError{Field: "code", Message: "Invalid authentication code"})
+		return
+	default:
+		writeSaveError(w, err, "Failed to enable two-factor authentication")
+		return
+	}
+
+	s.recordAudit(r, username, auditTwoFactorEnabled, username, nil)
+
+	tokens, err := s.issueTokenPair(user)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to issue session tokens")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"recoveryCodes": codes, "tokens": tokens})
+}
+
+// Turn off two-factor authentication. The caller re-authenticates with their
+// password and a current TOTP or recovery code.
+func (s *Server) handleTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
+
+	username := authenticatedUsername(r)
+
+	user, err := s.users.GetUser(r.Context(), username)
+	if err != nil {
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
+	}
+
+	if !user.TwoFactor.Enabled {
+		writeError(w, http.StatusConflict, codeConflict, "Two-factor authentication is not enabled")
+		return
+	}
+
+	// Guesses here count towards the same limits as at login, so this cannot
+	// be used to try passwords without them
+	if wait := s.loginLimiter.retryAfter(clientIP(r)); wait > 0 {
+		writeRetryAfter(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later", wait)
+		return
+	}
+	if wait := time.Until(user.LockedUntil); wait > 0 {
+		writeRetryAfter(w, http.StatusLocked, "Account is temporarily locked after too many failed login attempts", wait)
+		return
+	}
+
+	if !CheckPasswordHash(requestData.Password, user.PasswordHash) {
+		s.rejectCredentials(w, r, username, "bad_password", "Password is incorrect")
+		return
+	}
+
+	ok, err := s.checkSecondFactor(r, user, requestData.Code, requestData.RecoveryCode)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to verify authentication code")
+		return
+	}
+	if !ok {
+		s.rejectCredentials(w, r, username, "bad_2fa_code", "Invalid authentication code")
+		return
+	}
+
+	// Using the code bumped the stored version, so save through updateUser
+	// rather than the copy read above
+	user, err = s.updateUser(r.Context(), username, func(user *User) error {
+		user.TwoFactor = TwoFactorSettings{}
+		user.TokenVersion++
+		return nil
+	})
+	if err != nil {
+		writeSaveError(w, err, "Failed to disable two-factor authentication")
+		return
+	}
+
+	s.recordAudit(r, username, auditTwoFactorDisabled, username, nil)
+
+	s.writeRenewedSession(w, user, "Two-factor authentication disabled")
+}
+
+// Check a TOTP code or, failing that, a recovery code. Both are single-use:
+// the TOTP time step is recorded and a recovery code is removed when used.
+func (s *Server) checkSecondFactor(r *http.Request, user User, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		step := verifyTOTP(user.TwoFactor.Secret, code, user.TwoFactor.LastUsedStep, time.Now())
+		if step < 0 {
+			return false, nil
+		}
+
+		return s.users.UseTOTPStep(r.Context(), user.Username, step)
+	}
+
+	if recoveryCode != "" {
+		codeHash := hashToken(recoveryCode)
+		used, err := s.users.UseRecoveryCode(r.Context(), user.Username, codeHash)
+		if err != nil {
+			return false, err
+		}
+		if used {
+			s.recordAudit(r, user.Username, auditRecoveryCodeUsed, user.Username, nil)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Generate recovery codes, returning the plain codes and their hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(raw)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashToken(codes[i])
+	}
+	return codes, hashes, nil
+}
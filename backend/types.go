@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/gorilla/websocket"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 // Define types for the User and UserRequest structures
@@ -41,6 +41,7 @@ type UserRequest struct {
 	StreakData       StreakDataRequestType `json:"streakData"`
 	UserProfileImage ProfileImage          `json:"userProfileImage"`
 	OngoingLevel     float64               `json:"ongoingLevel"`
+	ParentEmail      string                `json:"parentEmail"` // required below the parental consent age
 }
 
 type User struct {
@@ -55,6 +56,43 @@ type User struct {
 	PasswordHash     string           `json:"-"` // password is excluded from JSON
 	StreakData       StreakDataType   `json:"streakData"`
 	UserProfileImage ProfileImage     `json:"userProfileImage"`
+	Role             string           `json:"role"` // student, teacher or admin
+	// nil for accounts created before email verification existed, which are
+	// treated as verified
+	EmailVerified *bool `json:"emailVerified,omitempty"`
+	// Consecutive failed logins and the time until which login is refused
+	FailedLoginAttempts int               `json:"-"`
+	LockedUntil         time.Time         `json:"-"`
+	TwoFactor           TwoFactorSettings `json:"-"`
+	// Set for accounts created below the parental consent age
+	ParentalConsent *ParentalConsent `json:"parentalConsent,omitempty"`
+	// When the account will be purged, nil unless the user asked for deletion
+	DeletionScheduledFor *time.Time `json:"deletionScheduledFor,omitempty"`
+	// Carried by every token issued to the user. Incrementing it revokes all
+	// of them, e.g. when the password or the role changes.
+	TokenVersion int `json:"-"`
+	// Incremented on every write, for optimistic concurrency
+	Version int `json:"-"`
+}
+
+// TOTP two-factor authentication state for a user
+type TwoFactorSettings struct {
+	Enabled       bool
+	Secret        string   // base32 TOTP secret
+	PendingSecret string   // secret awaiting confirmation during enrollment
+	RecoveryCodes []string // SHA-256 hashes of the unused recovery codes
+	LastUsedStep  int64    // last accepted TOTP time step, to stop replays
+}
+
+func (u User) isEmailUnverified() bool {
+	return u.EmailVerified != nil && !*u.EmailVerified
+}
+
+// Public view of a user shown on the leaderboard
+type LeaderboardEntry struct {
+	Username         string       `json:"username"`
+	MultiPlayerScore int          `json:"multiPlayerScore"`
+	UserProfileImage ProfileImage `json:"userProfileImage"`
 }
 
 // Define types for the Lobby, Question, and GameState structures
@@ -65,42 +103,74 @@ type Lobby struct {
 	Participants []string       `json:"participants"`
 	Status       string         `json:"status"`
 	CreatedAt    time.Time      `json:"createdAt"`
-	Scores       map[string]int `json:"scores"`       // Add Scores field
-	CurrentIndex int            `json:"currentIndex"` // Add CurrentQuestion field
+	EndedAt      *time.Time     `json:"endedAt,omitempty"`    // set when the game ends
+	ProgressAt   *time.Time     `json:"progressAt,omitempty"` // when the game started or last saved its progress
+	Scores       map[string]int `json:"scores"`               // Add Scores field
+	CurrentIndex int            `json:"currentIndex"`         // Add CurrentQuestion field
+	Version      int            `json:"-"`                    // incremented on every write
 }
 
 type Question struct {
 	ID            string   `json:"id" bson:"_id,omitempty"`
 	QuestionText  string   `json:"questionText"`
 	Options       []string `json:"options"`
-	CorrectAnswer string   `json:"correctAnswer"`
+	CorrectAnswer string   `json:"correctAnswer,omitempty"` // never sent to players
 }
 
 // Removed duplicate Message struct definition
 type Server struct {
-	serverAddress     string
-	mongoClient       *mongo.Client
-	usersCollection   *mongo.Collection
-	lobbiesCollection *mongo.Collection
+	serverAddress string
+	tokenSecret   []byte // HMAC key for signing access and refresh tokens
+	users         UserStore
+	lobbies       LobbyStore
+	tokens        TokenStore // single-use tokens such as password resets
+	auditLog      AuditStore // append-only security audit trail
+	consents      ConsentStore
+	store         Store // the whole backend, for the readiness probe
+	loginLimiter  *attemptLimiter
+	// Password reset requests per client IP and per username
+	resetIPLimiter      *attemptLimiter
+	resetAccountLimiter *attemptLimiter
+	// Users younger than this need a parent's approval for community features
+	parentalConsentAge int
+	mailer             Mailer
+	appBaseURL         string         // frontend URL used to build links in emails
+	corsOrigins        []string       // origins allowed by CORS, or "*"
+	trustedProxies     []netip.Prefix // whose X-Forwarded-For is believed
+	// Waiting lobbies are deleted lobbyWaitingTTL after they were created,
+	// ended ones archived lobbyArchiveAfter after the game ended, and active
+	// ones ended lobbyStaleAfter after their game last progressed
+	lobbyWaitingTTL      time.Duration
+	lobbyArchiveAfter    time.Duration
+	lobbyStaleAfter      time.Duration
+	lobbyCleanupInterval time.Duration
+	// Multiplayer questions go unanswered after answerTimeout; answers gain
+	// correctAnswerPoints or lose wrongAnswerPenalty
+	answerTimeout       time.Duration
+	correctAnswerPoints int
+	wrongAnswerPenalty  int
+	shutdownTimeout     time.Duration
+	metricsToken        string      // bearer token for /metrics, if required
+	draining            atomic.Bool // set once a shutdown has begun
 	// questionsCollection *mongo.Collection
-	mutex           sync.Mutex // Add a mutex for concurrency safety
-	clients         map[*websocket.Conn]bool
-	broadcast       chan Message
-	userConnections map[string]*websocket.Conn
+	// Multiplayer games this process is running, by lobby ID, and the
+	// context stopping them on shutdown
+	gamesMu   sync.Mutex // guards games
+	games     map[string]*liveGame
+	gamesCtx  context.Context
+	stopGames context.CancelFunc
+	gamesDone sync.WaitGroup // running playGame calls
 }
 
-// Define the Message type
-type Message struct {
-	LobbyID    string `json:"lobbyId"`
-	Username   string `json:"username"`
-	Answer     string `json:"answer"`
-	QuestionID string `json:"questionId"`
-	Action     string `json:"action"`
-}
+// Key type for values stored in a request context
+type contextKey string
 
+const usernameContextKey contextKey = "username"
+
+// Answer sent by a player over the game WebSocket
 type Answer struct {
-	Username string `json:"username"`
-	Answer   string `json:"answer"`
+	Index  int    `json:"index"` // of the question answered
+	Answer string `json:"answer"`
 }
 
 type JoinLobbyRequest struct {
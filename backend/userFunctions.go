@@ -1,48 +1,83 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"log/slog"
 	"net/http"
+	"net/mail"
+	"slices"
+	"strings"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"golang.org/x/crypto/bcrypt"
 )
 
+var (
+	errParentEmailRequired = errors.New("a parent or guardian email is required")
+	errParentEmailIsOwn    = errors.New("the parent or guardian email is the user's own")
+)
+
 // Handle user login
 func (s *Server) userLoginHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	var requestData struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
 		return
 	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	// Refuse clients that have been guessing across many accounts
+	ip := clientIP(r)
+	if wait := s.loginLimiter.retryAfter(ip); wait > 0 {
+		writeRetryAfter(w, http.StatusTooManyRequests, "Too many failed login attempts, try again later", wait)
+		return
+	}
 
-	var user User
-	err := s.usersCollection.FindOne(context.TODO(), bson.M{"username": requestData.Username}).Decode(&user)
+	user, err := s.users.GetUser(r.Context(), requestData.Username)
 	if err != nil {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		s.recordLoginFailure(r, requestData.Username, "unknown_user")
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "Invalid username or password")
+		return
+	}
+
+	// Checked before the password so a locked account costs no bcrypt work
+	if wait := time.Until(user.LockedUntil); wait > 0 {
+		loginsTotal.WithLabelValues("failed").Inc()
+		s.recordAudit(r, "", auditLoginFailed, user.Username, map[string]string{"reason": "locked"})
+		writeRetryAfter(w, http.StatusLocked, "Account is temporarily locked after too many failed login attempts", wait)
 		return
 	}
 
 	if !CheckPasswordHash(requestData.Password, user.PasswordHash) {
-		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		s.rejectCredentials(w, r, user.Username, "bad_password", "Invalid username or password")
+		return
+	}
+
+	s.loginLimiter.forget(ip)
+	if user.FailedLoginAttempts > 0 {
+		if err := s.resetFailedLogins(r.Context(), user.Username); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to reset failed login counter", "username", user.Username, "error", err)
+		}
+	}
+
+	// Accounts with two-factor authentication get a short-lived challenge token
+	// instead of a session; it is exchanged at /user/login/2fa with a code
+	if user.TwoFactor.Enabled {
+		s.writeTwoFactorChallenge(w, user)
 		return
 	}
 
+	loginsTotal.WithLabelValues("succeeded").Inc()
+	s.recordAudit(r, user.Username, auditLoginSucceeded, user.Username, nil)
+	s.writeLoginResponse(w, user)
+}
+
+// Send the profile and a new session token pair to a user who just logged in
+func (s *Server) writeLoginResponse(w http.ResponseWriter, user User) {
 	// Create a response struct with formatted DOB
 	type UserResponse struct {
 		FirstName        string           `json:"firstName"`
@@ -55,6 +90,18 @@ func (s *Server) userLoginHandler(w http.ResponseWriter, r *http.Request) {
 		StreakData       StreakDataType   `json:"streakData"`
 		UserProfileImage ProfileImage     `json:"userProfileImage"`
 		OngoingLevel     float64          `json:"ongoingLevel"`
+		Role             string           `json:"role"`
+		EmailVerified    bool             `json:"emailVerified"`
+		// Until a parent approves, the frontend hides chat and multiplayer
+		ParentalConsentPending bool       `json:"parentalConsentPending"`
+		DeletionScheduledFor   *time.Time `json:"deletionScheduledFor,omitempty"`
+		Tokens                 TokenPair  `json:"tokens"`
+	}
+
+	tokens, err := s.issueTokenPair(user)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to issue session tokens")
+		return
 	}
 
 	// Remove password hash before sending user info
@@ -64,119 +111,120 @@ func (s *Server) userLoginHandler(w http.ResponseWriter, r *http.Request) {
 	formattedDOB := user.DOB.Format("2006-01-02")
 
 	userResponse := UserResponse{
-		FirstName:        user.FirstName,
-		LastName:         user.LastName,
-		Username:         user.Username,
-		Email:            user.Email,
-		DOB:              formattedDOB, // Use the formatted DOB here
-		CompletedLevels:  user.CompletedLevels,
-		MultiPlayerScore: user.MultiPlayerScore,
-		StreakData:       user.StreakData,
-		UserProfileImage: user.UserProfileImage,
-		OngoingLevel:     user.OngoingLevel,
-	}
-
-	userJSON, err := json.Marshal(userResponse)
-	if err != nil {
-		http.Error(w, "Failed to encode user data", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(userJSON)
+		FirstName:              user.FirstName,
+		LastName:               user.LastName,
+		Username:               user.Username,
+		Email:                  user.Email,
+		DOB:                    formattedDOB, // Use the formatted DOB here
+		CompletedLevels:        user.CompletedLevels,
+		MultiPlayerScore:       user.MultiPlayerScore,
+		StreakData:             user.StreakData,
+		UserProfileImage:       user.UserProfileImage,
+		OngoingLevel:           user.OngoingLevel,
+		Role:                   user.EffectiveRole(),
+		EmailVerified:          !user.isEmailUnverified(),
+		ParentalConsentPending: user.awaitingParentalConsent(),
+		DeletionScheduledFor:   user.DeletionScheduledFor,
+		Tokens:                 tokens,
+	}
+
+	writeJSON(w, http.StatusOK, userResponse)
 }
 
-// Handle getting and adding users
-func (s *Server) usersHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		s.handleGetUsers(w)
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// Exchange a valid refresh token for a new access/refresh token pair
+func (s *Server) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var requestData struct {
+		RefreshToken string `json:"refreshToken"`
 	}
-}
 
-// Retrieve all users
-func (s *Server) handleGetUsers(w http.ResponseWriter) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
+		return
+	}
 
-	cursor, err := s.usersCollection.Find(context.TODO(), bson.M{})
+	// The account must still exist and not have revoked its sessions
+	user, err := s.authenticateToken(r.Context(), requestData.RefreshToken, refreshTokenType)
+	if err == errInvalidToken {
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "Invalid or expired refresh token")
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to retrieve users", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to look up user")
 		return
 	}
-	defer cursor.Close(context.TODO())
 
-	var users []User
-	if err = cursor.All(context.TODO(), &users); err != nil {
-		http.Error(w, "Failed to decode users list", http.StatusInternalServerError)
+	tokens, err := s.issueTokenPair(user)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to issue session tokens")
 		return
 	}
 
-	usersJSON, err := json.Marshal(users)
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// List every user (admin only)
+func (s *Server) usersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := s.users.ListUsers(r.Context())
 	if err != nil {
-		http.Error(w, "Failed to marshal users list", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve users")
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(usersJSON)
+
+	writeJSON(w, http.StatusOK, users)
 }
 
-// Update the main route handler to include password change
-func (s *Server) userHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
-		s.handleGetUser(w, r)
-	case "POST":
-		path := r.URL.Path
-		if path == "/user/add" {
-			s.handleAddUser(w, r)
-		} else if path == "/user/modify" {
-			fmt.Println("userHandler has been touched")
-			s.handleModifyUser(w, r)
-		} else if path == "/user/change-password" {
-			s.handleChangePassword(w, r)
-		} else {
-			http.Error(w, "Invalid POST path", http.StatusNotFound)
-		}
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// Number of players shown on the leaderboard
+const leaderboardSize = 100
+
+// Public leaderboard: usernames and multiplayer scores of the top players,
+// highest first. Children are only listed once a parent has approved.
+func (s *Server) leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := s.users.TopUsersByScore(r.Context(), leaderboardSize)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve leaderboard")
+		return
+	}
+
+	entries := make([]LeaderboardEntry, 0, len(users))
+	for _, user := range users {
+		entries = append(entries, LeaderboardEntry{
+			Username:         user.Username,
+			MultiPlayerScore: user.MultiPlayerScore,
+			UserProfileImage: user.UserProfileImage,
+		})
 	}
+
+	writeJSON(w, http.StatusOK, entries)
 }
 
-// Retrieve a single user by username
+// Retrieve the profile named in the path, or the caller's own on the
+// deprecated route without one. Only admins can read other users' profiles.
 func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
-	var requestData struct {
-		Username string `json:"username"`
+	username := r.PathValue("username")
+	if username == "" {
+		username = authenticatedUsername(r)
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	if username != authenticatedUsername(r) {
+		caller, err := s.users.GetUser(r.Context(), authenticatedUsername(r))
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "User not found")
+			return
+		}
+		if caller.EffectiveRole() != RoleAdmin {
+			writeError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+			return
+		}
 	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	var user User
-	err := s.usersCollection.FindOne(context.TODO(), bson.M{"username": requestData.Username}).Decode(&user)
+	user, err := s.users.GetUser(r.Context(), username)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
 		return
 	}
 
 	user.PasswordHash = ""
-	userData, err := json.Marshal(user)
-	if err != nil {
-		http.Error(w, "Failed to encode user data", http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(userData)
+	writeJSON(w, http.StatusOK, user)
 }
 
 // Hash password for storage
@@ -195,36 +243,32 @@ func CheckPasswordHash(password, hash string) bool {
 func (s *Server) handleAddUser(w http.ResponseWriter, r *http.Request) {
 	var newUserReq UserRequest
 	if err := json.NewDecoder(r.Body).Decode(&newUserReq); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
 		return
 	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	count, err := s.usersCollection.CountDocuments(context.TODO(), bson.M{"username": newUserReq.Username})
-	if err != nil {
-		http.Error(w, "Error checking username uniqueness", http.StatusInternalServerError)
-		return
-	}
-	if count > 0 {
-		http.Error(w, "Username already exists", http.StatusConflict)
+	if fields := newUserReq.validateSignup(s.requiresParentalConsent); len(fields) > 0 {
+		writeValidationError(w, fields...)
 		return
 	}
+	dob, _ := time.Parse("2006-01-02", newUserReq.DOB)
 
-	dob, err := time.Parse("2006-01-02", newUserReq.DOB)
-	if err != nil {
-		http.Error(w, "Invalid DOB format, should be YYYY-MM-DD", http.StatusBadRequest)
-		return
+	// Children start restricted until a parent or guardian approves the account
+	var parentalConsent *ParentalConsent
+	if s.requiresParentalConsent(dob) {
+		parentalConsent = &ParentalConsent{
+			ParentEmail: newUserReq.ParentEmail,
+			RequestedAt: time.Now(),
+		}
 	}
 
 	passwordHash, err := HashPassword(newUserReq.Password)
 	if err != nil {
-		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to hash password")
 		return
 	}
 
-	// Parse streak data dates
+	// Parse streak data dates, which were validated when given
 	latestPlayed, _ := time.Parse("2006-01-02", newUserReq.StreakData.LatestPlayed)
 	latestStreakStartDate, _ := time.Parse("2006-01-02", newUserReq.StreakData.LatestStreakStartDate)
 
@@ -243,96 +287,190 @@ func (s *Server) handleAddUser(w http.ResponseWriter, r *http.Request) {
 		},
 		UserProfileImage: newUserReq.UserProfileImage,
 		OngoingLevel:     newUserReq.OngoingLevel,
+		Role:             RoleStudent,
+		EmailVerified:    new(bool),
+		ParentalConsent:  parentalConsent,
 	}
 
-	_, err = s.usersCollection.InsertOne(context.TODO(), newUser)
+	err = s.users.CreateUser(r.Context(), newUser)
+	if err == ErrUserExists {
+		writeError(w, http.StatusConflict, codeUsernameTaken, "Username already exists")
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to add user", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to add user")
 		return
 	}
+	signupsTotal.Inc()
 
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte("User added successfully"))
+	// The account exists even if the email fails; the user can ask for a resend
+	if err := s.sendVerificationEmail(r.Context(), newUser); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to send verification email", "username", newUser.Username, "error", err)
+	}
+	if parentalConsent != nil {
+		if err := s.sendParentalConsentEmail(r.Context(), newUser); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to send parental consent email", "username", newUser.Username, "error", err)
+		}
+	}
+
+	writeMessage(w, http.StatusCreated, "User added successfully")
 }
 
 // Modify an existing user (for general updates without password change)
 func (s *Server) handleModifyUser(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("handleModifyUser has been touched")
 	var modifyUserReq UserRequest
 	if err := json.NewDecoder(r.Body).Decode(&modifyUserReq); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
 		return
 	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	// Only the authenticated user can be modified; a username in the body is
+	// accepted for backwards compatibility but must match the caller
+	username := authenticatedUsername(r)
+	if modifyUserReq.Username != "" && modifyUserReq.Username != username {
+		writeError(w, http.StatusForbidden, codeForbidden, "Cannot modify another user")
+		return
+	}
 
-	var user User
-	fmt.Println("searching for user")
-	err := s.usersCollection.FindOne(context.TODO(), bson.M{"username": modifyUserReq.Username}).Decode(&user)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+	if fields := modifyUserReq.validateUpdate(); len(fields) > 0 {
+		writeValidationError(w, fields...)
 		return
 	}
-	fmt.Println("user found")
-	// Update the profile fields (excluding password)
-	if modifyUserReq.FirstName != "" {
-		user.FirstName = modifyUserReq.FirstName
+	dob, _ := time.Parse("2006-01-02", modifyUserReq.DOB)
+
+	// Applied to a fresh copy of the user each time a concurrent update wins
+	var original User
+	var consentRequested, emailChanged bool
+	user, err := s.updateUser(r.Context(), username, func(user *User) error {
+		original = *user
+		// Update the profile fields (excluding password)
+		if modifyUserReq.FirstName != "" {
+			user.FirstName = modifyUserReq.FirstName
+		}
+		if modifyUserReq.LastName != "" {
+			user.LastName = modifyUserReq.LastName
+		}
+		consentRequested = false
+		emailChanged = modifyUserReq.Email != "" && modifyUserReq.Email != user.Email
+		if emailChanged {
+			// A new address has to be verified again
+			user.Email = modifyUserReq.Email
+			user.EmailVerified = new(bool)
+		}
+		if modifyUserReq.OngoingLevel > user.OngoingLevel {
+			user.OngoingLevel = modifyUserReq.OngoingLevel
+		}
+		if modifyUserReq.DOB != "" {
+			user.DOB = dob
+
+			// Moving the DOB below the consent age restricts the account like a
+			// new signup. An existing consent request is kept as is.
+			if user.ParentalConsent == nil && s.requiresParentalConsent(dob) {
+				if _, err := mail.ParseAddress(modifyUserReq.ParentEmail); err != nil {
+					return errParentEmailRequired
+				}
+				if isSameEmail(modifyUserReq.ParentEmail, user.Email) {
+					return errParentEmailIsOwn
+				}
+				user.ParentalConsent = &ParentalConsent{
+					ParentEmail: modifyUserReq.ParentEmail,
+					RequestedAt: time.Now(),
+				}
+				consentRequested = true
+			}
+		}
+		if len(modifyUserReq.CompletedLevels) > 0 {
+			user.CompletedLevels = modifyUserReq.CompletedLevels
+		}
+		if modifyUserReq.MultiPlayerScore > 0 {
+			user.MultiPlayerScore = modifyUserReq.MultiPlayerScore
+		}
+
+		// Parse streak data
+		if modifyUserReq.StreakData.LatestPlayed != "" {
+			latestPlayed, _ := time.Parse("2006-01-02", modifyUserReq.StreakData.LatestPlayed)
+			user.StreakData.LatestPlayed = latestPlayed
+		}
+		if modifyUserReq.StreakData.LatestStreakStartDate != "" {
+			latestStreakStartDate, _ := time.Parse("2006-01-02", modifyUserReq.StreakData.LatestStreakStartDate)
+			user.StreakData.LatestStreakStartDate = latestStreakStartDate
+		}
+
+		if modifyUserReq.UserProfileImage.Path != "" {
+			user.UserProfileImage.Path = modifyUserReq.UserProfileImage.Path
+		}
+		if modifyUserReq.UserProfileImage.Format != "" {
+			user.UserProfileImage.Format = modifyUserReq.UserProfileImage.Format
+		}
+		return nil
+	})
+	if err == ErrNotFound {
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
+		return
 	}
-	if modifyUserReq.LastName != "" {
-		user.LastName = modifyUserReq.LastName
+	if err == errParentEmailRequired {
+		writeValidationError(w, FieldError{Field: "parentEmail", Message: "A valid parent or guardian email is required for users under the age of consent"})
+		return
 	}
-	if modifyUserReq.Email != "" {
-		user.Email = modifyUserReq.Email
+	if err == errParentEmailIsOwn {
+		writeValidationError(w, FieldError{Field: "parentEmail", Message: parentEmailIsOwnMessage})
+		return
 	}
-	if modifyUserReq.OngoingLevel > user.OngoingLevel {
-		user.OngoingLevel = modifyUserReq.OngoingLevel
+	if err != nil {
+		writeSaveError(w, err, "Failed to update user")
+		return
 	}
-	if modifyUserReq.DOB != "" {
-		dob, err := time.Parse("2006-01-02", modifyUserReq.DOB)
-		if err != nil {
-			http.Error(w, "Invalid DOB format, should be YYYY-MM-DD", http.StatusBadRequest)
-			return
-		}
 
-		user.DOB = dob
+	if changed := changedProfileFields(original, user); len(changed) > 0 {
+		s.recordAudit(r, username, auditProfileUpdated, username, map[string]string{"fields": strings.Join(changed, ",")})
 	}
-	// fmt.Println("DOB issue")
-	if len(modifyUserReq.CompletedLevels) > 0 {
-		user.CompletedLevels = modifyUserReq.CompletedLevels
+
+	if emailChanged {
+		if err := s.sendVerificationEmail(r.Context(), user); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to send verification email", "error", err)
+		}
 	}
-	if modifyUserReq.MultiPlayerScore > 0 {
-		user.MultiPlayerScore = modifyUserReq.MultiPlayerScore
+	if consentRequested {
+		if err := s.sendParentalConsentEmail(r.Context(), user); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to send parental consent email", "error", err)
+		}
 	}
 
-	// Parse streak data
-	if modifyUserReq.StreakData.LatestPlayed != "" {
-		latestPlayed, _ := time.Parse("2006-01-02", modifyUserReq.StreakData.LatestPlayed)
-		user.StreakData.LatestPlayed = latestPlayed
+	writeMessage(w, http.StatusOK, "User modified successfully")
+}
+
+// Names of the profile fields that differ between two versions of a user
+func changedProfileFields(before, after User) []string {
+	var changed []string
+	if before.FirstName != after.FirstName {
+		changed = append(changed, "firstName")
 	}
-	if modifyUserReq.StreakData.LatestStreakStartDate != "" {
-		latestStreakStartDate, _ := time.Parse("2006-01-02", modifyUserReq.StreakData.LatestStreakStartDate)
-		user.StreakData.LatestStreakStartDate = latestStreakStartDate
+	if before.LastName != after.LastName {
+		changed = append(changed, "lastName")
 	}
-
-	if modifyUserReq.UserProfileImage.Path != "" {
-		user.UserProfileImage.Path = modifyUserReq.UserProfileImage.Path
+	if before.Email != after.Email {
+		changed = append(changed, "email")
 	}
-	if modifyUserReq.UserProfileImage.Format != "" {
-		user.UserProfileImage.Format = modifyUserReq.UserProfileImage.Format
+	if !before.DOB.Equal(after.DOB) {
+		changed = append(changed, "dob")
 	}
-
-	// Update the user document in the database
-	_, err = s.usersCollection.UpdateOne(context.TODO(), bson.M{"username": modifyUserReq.Username}, bson.M{"$set": user})
-	if err != nil {
-		http.Error(w, "Failed to update user", http.StatusInternalServerError)
-		return
+	if before.OngoingLevel != after.OngoingLevel {
+		changed = append(changed, "ongoingLevel")
 	}
-
-	// fmt.Println("Updation issue")
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("User modified successfully"))
+	if !slices.Equal(before.CompletedLevels, after.CompletedLevels) {
+		changed = append(changed, "completedLevels")
+	}
+	if before.MultiPlayerScore != after.MultiPlayerScore {
+		changed = append(changed, "multiPlayerScore")
+	}
+	if !before.StreakData.LatestPlayed.Equal(after.StreakData.LatestPlayed) ||
+		!before.StreakData.LatestStreakStartDate.Equal(after.StreakData.LatestStreakStartDate) {
+		changed = append(changed, "streakData")
+	}
+	if before.UserProfileImage != after.UserProfileImage {
+		changed = append(changed, "userProfileImage")
+	}
+	return changed
 }
 
 // Change password handler
@@ -344,40 +482,52 @@ func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&passwordChangeReq); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeInvalidRequest, "Invalid request payload")
 		return
 	}
 
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	username := authenticatedUsername(r)
+	if passwordChangeReq.Username != "" && passwordChangeReq.Username != username {
+		writeError(w, http.StatusForbidden, codeForbidden, "Cannot change another user's password")
+		return
+	}
 
-	var user User
-	err := s.usersCollection.FindOne(context.TODO(), bson.M{"username": passwordChangeReq.Username}).Decode(&user)
+	if fields := validatePassword("newPassword", passwordChangeReq.NewPassword); len(fields) > 0 {
+		writeValidationError(w, fields...)
+		return
+	}
+
+	user, err := s.users.GetUser(r.Context(), username)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, codeNotFound, "User not found")
 		return
 	}
 
 	// Check if the current password is correct
 	if !CheckPasswordHash(passwordChangeReq.CurrentPassword, user.PasswordHash) {
-		http.Error(w, "Current password is incorrect", http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, codeUnauthorized, "Current password is incorrect")
 		return
 	}
 
 	// Hash the new password
 	newPasswordHash, err := HashPassword(passwordChangeReq.NewPassword)
 	if err != nil {
-		http.Error(w, "Failed to hash new password", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, codeInternal, "Failed to hash new password")
 		return
 	}
 
-	// Update the password in the database
-	_, err = s.usersCollection.UpdateOne(context.TODO(), bson.M{"username": passwordChangeReq.Username}, bson.M{"$set": bson.M{"passwordHash": newPasswordHash}})
+	// Update the password in the database, signing out every other session
+	user, err = s.updateUser(r.Context(), username, func(user *User) error {
+		user.PasswordHash = newPasswordHash
+		user.TokenVersion++
+		return nil
+	})
 	if err != nil {
-		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		writeSaveError(w, err, "Failed to update password")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Password changed successfully"))
+	s.recordAudit(r, username, auditPasswordChanged, username, nil)
+
+	s.writeRenewedSession(w, user, "Password changed successfully")
 }
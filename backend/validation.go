@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Levels are numbered 1 to gameLevelCount, as in gameLevelsModified in the
+// frontend. ongoingLevel reaches gameLevelCount+1 once every level is done.
+const gameLevelCount = 8
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	minPasswordLength = 8
+	// bcrypt ignores everything after 72 bytes
+	maxPasswordBytes  = 72
+	maxNameLength     = 64
+	maxImageLength    = 2048
+	maxAgeYears       = 120
+	maxLobbyQuestions = 50
+	maxLobbyOptions   = 6
+	maxQuestionLength = 500
+)
+
+// Placeholder the frontend sends for streak dates that are not set yet; it
+// is stored as the zero time
+const unsetDate = "0000-00-00"
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// A check on a single string value, returning what is wrong with it or ""
+type rule func(value string) string
+
+// Collects field errors while a request is checked rule by rule
+type validator struct {
+	fields []FieldError
+}
+
+func (v *validator) add(field, message string) {
+	v.fields = append(v.fields, FieldError{Field: field, Message: message})
+}
+
+// Record a field error unless ok
+func (v *validator) check(ok bool, field, message string) {
+	if !ok {
+		v.add(field, message)
+	}
+}
+
+// Apply rules to a value in order, recording the first that fails
+func (v *validator) field(field, value string, rules ...rule) {
+	for _, r := range rules {
+		if message := r(value); message != "" {
+			v.add(field, message)
+			return
+		}
+	}
+}
+
+// Like field, but an empty value passes, for fields that are left unchanged
+// when omitted
+func (v *validator) optional(field, value string, rules ...rule) {
+	if value != "" {
+		v.field(field, value, rules...)
+	}
+}
+
+// Rules
+
+func required(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "Is required"
+	}
+	return ""
+}
+
+func maxLength(n int) rule {
+	return func(value string) string {
+		if utf8.RuneCountInString(value) > n {
+			return fmt.Sprintf("Must be at most %d characters", n)
+		}
+		return ""
+	}
+}
+
+func usernameRule(value string) string {
+	if length := len(value); length < minUsernameLength || length > maxUsernameLength {
+		return fmt.Sprintf("Must be %d to %d characters", minUsernameLength, maxUsernameLength)
+	}
+	if !usernamePattern.MatchString(value) {
+		return "May only contain letters, digits, dots, hyphens and underscores"
+	}
+	return ""
+}
+
+func emailRule(value string) string {
+	address, err := mail.ParseAddress(value)
+	if err != nil || address.Address != value || len(value) > 254 {
+		return "Invalid email address"
+	}
+	return ""
+}
+
+func passwordRule(value string) string {
+	if utf8.RuneCountInString(value) < minPasswordLength {
+		return fmt.Sprintf("Must be at least %d characters", minPasswordLength)
+	}
+	if len(value) > maxPasswordBytes {
+		return fmt.Sprintf("Must be at most %d bytes", maxPasswordBytes)
+	}
+	if !strings.ContainsFunc(value, unicode.IsLetter) || !strings.ContainsFunc(value, unicode.IsDigit) {
+		return "Must contain at least one letter and one digit"
+	}
+	return ""
+}
+
+// A YYYY-MM-DD date that is not in the future
+func pastDateRule(value string) string {
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return "Invalid date format, should be YYYY-MM-DD"
+	}
+	// A day of slack for clients ahead of UTC
+	if date.After(time.Now().Add(24 * time.Hour)) {
+		return "Must not be in the future"
+	}
+	return ""
+}
+
+func dobRule(value string) string {
+	if message := pastDateRule(value); message != "" {
+		return message
+	}
+	dob, _ := time.Parse("2006-01-02", value)
+	if ageOn(dob, time.Now()) > maxAgeYears {
+		return fmt.Sprintf("Must be within the last %d years", maxAgeYears)
+	}
+	return ""
+}
+
+// Checks shared by signups and profile updates of fields that may be omitted
+func (req UserRequest) validateCommon(v *validator) {
+	v.optional("firstName", req.FirstName, maxLength(maxNameLength))
+	v.optional("lastName", req.LastName, maxLength(maxNameLength))
+	if req.StreakData.LatestPlayed != unsetDate {
+		v.optional("streakData.latestPlayed", req.StreakData.LatestPlayed, pastDateRule)
+	}
+	if req.StreakData.LatestStreakStartDate != unsetDate {
+		v.optional("streakData.latestStreakStartDate", req.StreakData.LatestStreakStartDate, pastDateRule)
+	}
+	v.optional("userProfileImage.format", req.UserProfileImage.Format, maxLength(maxNameLength))
+	v.optional("userProfileImage.path", req.UserProfileImage.Path, maxLength(maxImageLength))
+
+	v.check(req.MultiPlayerScore >= 0, "multiPlayerScore", "Must not be negative")
+	v.check(req.OngoingLevel >= 0 && req.OngoingLevel <= gameLevelCount+1, "ongoingLevel",
+		fmt.Sprintf("Must be between 0 and %d", gameLevelCount+1))
+
+	var seen []int
+	for i, level := range req.CompletedLevels {
+		field := fmt.Sprintf("completedLevels[%d]", i)
+		v.check(level.LevelID >= 1 && level.LevelID <= gameLevelCount, field+".levelId", "No such level")
+		v.check(!slices.Contains(seen, level.LevelID), field+".levelId", "Level is listed more than once")
+		v.check(level.Score >= 0, field+".score", "Must not be negative")
+		seen = append(seen, level.LevelID)
+	}
+}
+
+// Field errors of a signup. requiresConsent tells whether a date of birth is
+// below the parental consent age, which makes the parent's email required.
+func (req UserRequest) validateSignup(requiresConsent func(dob time.Time) bool) []FieldError {
+	var v validator
+	v.field("username", req.Username, required, usernameRule)
+	v.field("email", req.Email, required, emailRule)
+	v.field("password", req.Password, required, passwordRule)
+	v.field("dob", req.DOB, required, dobRule)
+	req.validateCommon(&v)
+
+	dob, _ := time.Parse("2006-01-02", req.DOB)
+	if dobRule(req.DOB) == "" && requiresConsent(dob) {
+		v.check(emailRule(req.ParentEmail) == "", "parentEmail", "A valid parent or guardian email is required for users under the age of consent")
+	} else {
+		v.optional("parentEmail", req.ParentEmail, emailRule)
+	}
+	v.check(!isSameEmail(req.ParentEmail, req.Email), "parentEmail", parentEmailIsOwnMessage)
+	return v.fields
+}
+
+// Field errors of a profile update, where empty fields are left unchanged
+func (req UserRequest) validateUpdate() []FieldError {
+	var v validator
+	v.optional("email", req.Email, emailRule)
+	v.optional("dob", req.DOB, dobRule)
+	v.optional("parentEmail", req.ParentEmail, emailRule)
+	// Checked against the stored address too when the update uses it
+	v.check(!isSameEmail(req.ParentEmail, req.Email), "parentEmail", parentEmailIsOwnMessage)
+	req.validateCommon(&v)
+	return v.fields
+}
+
+// A parent's email must be someone else's address, or children could
+// approve their own accounts
+const parentEmailIsOwnMessage = "Must be a parent or guardian's address, not your own"
+
+// Whether two addresses are the same, ignoring case. An empty address
+// matches nothing.
+func isSameEmail(a, b string) bool {
+	return a != "" && strings.EqualFold(a, b)
+}
+
+// Field errors of a new lobby's questions
+func (lobby Lobby) validateNew() []FieldError {
+	var v validator
+	v.check(len(lobby.Questions) > 0, "questions", "At least one question is required")
+	v.check(len(lobby.Questions) <= maxLobbyQuestions, "questions", fmt.Sprintf("At most %d questions are allowed", maxLobbyQuestions))
+
+	for i, question := range lobby.Questions {
+		field := fmt.Sprintf("questions[%d]", i)
+		v.field(field+".questionText", question.QuestionText, required, maxLength(maxQuestionLength))
+		v.check(len(question.Options) >= 2 && len(question.Options) <= maxLobbyOptions, field+".options",
+			fmt.Sprintf("Must have 2 to %d options", maxLobbyOptions))
+		for j, option := range question.Options {
+			optionField := fmt.Sprintf("%s.options[%d]", field, j)
+			v.field(optionField, option, required, maxLength(maxQuestionLength))
+			v.check(!slices.Contains(question.Options[:j], option), optionField, "Options must be unique")
+		}
+		v.check(slices.Contains(question.Options, question.CorrectAnswer), field+".correctAnswer", "Must be one of the options")
+	}
+	return v.fields
+}
+
+// Field errors of a new password, as chosen at signup, change or reset
+func validatePassword(field, password string) []FieldError {
+	var v validator
+	v.field(field, password, required, passwordRule)
+	return v.fields
+}